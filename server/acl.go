@@ -0,0 +1,140 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "strings"
+    "net/netip"
+    "sync/atomic"
+)
+
+// AccessList filters remote IP addresses with allow and deny CIDR lists.
+// An address matching a deny entry is rejected. If the allow list is not
+// empty, an address must also match one of its entries to be accepted.
+// Addresses that are not IP addresses, such as unix sockets, are accepted.
+//
+// Rules may be replaced at any time with SetRules, connections already
+// accepted are not affected.
+type AccessList struct {
+    rules atomic.Pointer[accessRules]
+}
+
+type accessRules struct {
+    allow []netip.Prefix
+    deny  []netip.Prefix
+}
+
+// NewAccessList creates an AccessList from allow and deny lists of CIDR
+// prefixes, such as "10.0.0.0/8" or "2001:db8::/32". A single address is
+// accepted as a prefix covering only this address.
+func NewAccessList(allow, deny []string) (*AccessList, error) {
+    acl := &AccessList{}
+    if err := acl.SetRules(allow, deny); err != nil {
+        return nil, err
+    }
+    return acl, nil
+}
+
+// SetRules atomically replaces the rules of the list. On error the previous
+// rules are kept.
+func (acl * AccessList) SetRules(allow, deny []string) (error) {
+    rules := &accessRules{}
+    var err error
+    if rules.allow, err = parsePrefixes(allow); err != nil {
+        return err
+    }
+    if rules.deny, err = parsePrefixes(deny); err != nil {
+        return err
+    }
+    acl.rules.Store(rules)
+    return nil
+}
+
+// Allowed reports whether addr passes the list.
+func (acl * AccessList) Allowed(addr net.Addr) (bool) {
+    ip, ok := remoteIP(addr)
+    if !ok {
+        return true
+    }
+    return acl.AllowedIP(ip)
+}
+
+// AllowedIP reports whether ip passes the list. The zone of an IPv6 address
+// is ignored.
+func (acl * AccessList) AllowedIP(ip netip.Addr) (bool) {
+    rules := acl.rules.Load()
+    if rules == nil {
+        return true
+    }
+    ip = ip.Unmap().WithZone("")
+    if matchPrefixes(rules.deny, ip) {
+        return false
+    }
+    return len(rules.allow) == 0 || matchPrefixes(rules.allow, ip)
+}
+
+func matchPrefixes(prefixes []netip.Prefix, ip netip.Addr) (bool) {
+    for _, p := range prefixes {
+        if p.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+    prefixes := make([]netip.Prefix, 0, len(list))
+    for _, s := range list {
+        s = strings.TrimSpace(s)
+        if !strings.Contains(s, "/") {
+            ip, err := netip.ParseAddr(s)
+            if err != nil {
+                return nil, err
+            }
+            ip = ip.Unmap().WithZone("")
+            prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+            continue
+        }
+        p, err := netip.ParsePrefix(s)
+        if err != nil {
+            return nil, err
+        }
+        if p.Addr().Is4In6() && p.Bits() >= 96 {
+            p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits() - 96)
+        }
+        prefixes = append(prefixes, p.Masked())
+    }
+    return prefixes, nil
+}
+
+// allowed applies the access list of the server to the remote address of a
+// newly accepted connection, before it reaches the worker pool, or to the
+// client address of its PROXY header.
+func (s * Server) allowed(addr net.Addr) (bool) {
+    if s.accessList == nil || s.accessList.Allowed(addr) {
+        return true
+    }
+    if s.onAccessDenied != nil {
+        s.onAccessDenied(addr)
+    }
+    return false
+}
@@ -0,0 +1,104 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "testing"
+    "net/netip"
+)
+
+func TestAccessList(t *testing.T) {
+    acl, err := NewAccessList([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"}, []string{"10.1.0.0/16"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct{
+        ip      string
+        allowed bool
+    }{
+        {"10.2.3.4",            true},
+        {"10.1.2.3",            false},
+        {"::ffff:10.2.3.4",     true},
+        {"192.168.1.1",         true},
+        {"192.168.1.2",         false},
+        {"2001:db8::1",         true},
+        {"2001:db9::1",         false},
+    }
+    for _, tt := range tests {
+        if got := acl.AllowedIP(netip.MustParseAddr(tt.ip)); got != tt.allowed {
+            t.Fatal(tt.ip, " allowed: ", got)
+        }
+    }
+    if err := acl.SetRules([]string{"bogus"}, nil); err == nil {
+        t.Fatal("invalid rule accepted")
+    }
+    if !acl.AllowedIP(netip.MustParseAddr("10.2.3.4")) {
+        t.Fatal("rules changed on error")
+    }
+    if !acl.Allowed(&net.UnixAddr{Name: "sock", Net: "unix"}) {
+        t.Fatal("non IP address denied")
+    }
+
+    zoned := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 1234}
+    if err := acl.SetRules(nil, []string{"fe80::/10"}); err != nil {
+        t.Fatal(err)
+    }
+    if acl.Allowed(zoned) {
+        t.Fatal("zoned link-local address escaped the deny list")
+    }
+    if err := acl.SetRules([]string{"fe80::/10"}, nil); err != nil {
+        t.Fatal(err)
+    }
+    if !acl.Allowed(zoned) {
+        t.Fatal("zoned link-local address rejected by the allow list")
+    }
+}
+
+func TestAccessListServer(t *testing.T) {
+    acl, _ := NewAccessList(nil, []string{"127.0.0.0/8"})
+    denied := make(chan net.Addr, 1)
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64),
+        WithAccessList(acl),
+        WithAccessDenied(func(addr net.Addr) { denied <- addr }))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    select {
+    case <-denied:
+    case <-time.After(time.Second):
+        t.Fatal("connection was not denied")
+    }
+
+    acl.SetRules([]string{"127.0.0.1"}, nil)
+    conn, err = net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    waitConnections(t, s, 1)
+}
@@ -0,0 +1,92 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "context"
+)
+
+// Context returns a context canceled when the connection is closed. Its
+// cause is the error that terminated the connection, or ErrClosed.
+func (c * Connection) Context() (context.Context) {
+    return c.ctx
+}
+
+// Set stores value under key in the connection's attributes. Keys follow
+// the same rules as context keys: use an unexported type, or a Key.
+func (c * Connection) Set(key, value any) {
+    c.attrMutex.Lock()
+    defer c.attrMutex.Unlock()
+    if c.attrs == nil {
+        c.attrs = make(map[any]any)
+    }
+    c.attrs[key] = value
+}
+
+// Get returns the attribute stored under key.
+func (c * Connection) Get(key any) (any, bool) {
+    c.attrMutex.RLock()
+    defer c.attrMutex.RUnlock()
+    value, ok := c.attrs[key]
+    return value, ok
+}
+
+// Delete removes the attribute stored under key.
+func (c * Connection) Delete(key any) {
+    c.attrMutex.Lock()
+    defer c.attrMutex.Unlock()
+    delete(c.attrs, key)
+}
+
+// GetAs returns the attribute stored under key if it is a T.
+func GetAs[T any](c *Connection, key any) (T, bool) {
+    value, ok := c.Get(key)
+    if !ok {
+        var zero T
+        return zero, false
+    }
+    v, ok := value.(T)
+    return v, ok
+}
+
+// Key is a typed attribute key. Every key returned by NewKey is distinct,
+// whatever its name.
+type Key[T any] struct {
+    name        string
+}
+
+func NewKey[T any](name string) (*Key[T]) {
+    return &Key[T]{name: name}
+}
+
+func (k * Key[T]) String() (string) {
+    return k.name
+}
+
+// Get returns the value stored under k on c.
+func (k * Key[T]) Get(c *Connection) (T, bool) {
+    return GetAs[T](c, k)
+}
+
+// Set stores value under k on c.
+func (k * Key[T]) Set(c *Connection, value T) {
+    c.Set(k, value)
+}
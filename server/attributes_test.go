@@ -0,0 +1,67 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "context"
+    "testing"
+)
+
+type userKey struct{}
+
+func TestConnectionAttributes(t *testing.T) {
+    local, remote := net.Pipe()
+    defer remote.Close()
+    c := NewConnection(nil, local)
+    c.handler = &ShutdownAwareHandler{}
+
+    c.Set(userKey{}, "alice")
+    if name, ok := GetAs[string](c, userKey{}); !ok || name != "alice" {
+        t.Fatal(name, ok)
+    }
+    if _, ok := GetAs[int](c, userKey{}); ok {
+        t.Fatal("attribute returned with the wrong type")
+    }
+
+    first, second := NewKey[int]("count"), NewKey[int]("count")
+    first.Set(c, 1)
+    if _, ok := second.Get(c); ok {
+        t.Fatal("keys with the same name collide")
+    }
+    if n, ok := first.Get(c); !ok || n != 1 {
+        t.Fatal(n, ok)
+    }
+    c.Delete(first)
+    if _, ok := first.Get(c); ok {
+        t.Fatal("attribute was not deleted")
+    }
+
+    ctx := c.Context()
+    if ctx.Err() != nil {
+        t.Fatal("context canceled before close")
+    }
+    c.Close()
+    <-ctx.Done()
+    if context.Cause(ctx) != ErrClosed {
+        t.Fatal(context.Cause(ctx))
+    }
+}
@@ -0,0 +1,84 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "testing"
+    "time"
+)
+
+func waitConnections(t *testing.T, s *Server, n int) ([]*Connection) {
+    for i := 0; i < 100; i++ {
+        if conns := s.Connections(); len(conns) == n {
+            return conns
+        }
+        time.Sleep(time.Millisecond * 10)
+    }
+    t.Fatal("expected ", n, " connections, got ", len(s.Connections()))
+    return nil
+}
+
+func TestBroadcast(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{})
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    var clients []net.Conn
+    for i := 0; i < 2; i++ {
+        conn, err := net.Dial("tcp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        clients = append(clients, conn)
+    }
+
+    conns := waitConnections(t, s, 2)
+    if conns[0].ID() >= conns[1].ID() {
+        t.Fatal("connections are not ordered by ID")
+    }
+    if c, ok := s.Get(conns[1].ID()); !ok || c != conns[1] {
+        t.Fatal("Get did not return the registered connection")
+    }
+    if _, ok := s.Get(0); ok {
+        t.Fatal("Get returned a connection for an unknown ID")
+    }
+
+    if n := s.Broadcast(&TelnetPacket{[]byte("all\n")}); n != 2 {
+        t.Fatal(n, " != 2")
+    }
+    last := conns[1].ID()
+    n := s.BroadcastFunc(func(c *Connection) bool {
+        return c.ID() == last
+    }, &TelnetPacket{[]byte("one\n")})
+    if n != 1 {
+        t.Fatal(n, " != 1")
+    }
+
+    b := make([]byte, 4)
+    for _, conn := range clients {
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        if _, err := conn.Read(b); err != nil || string(b) != "all\n" {
+            t.Fatal(string(b), err)
+        }
+    }
+}
@@ -0,0 +1,217 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "sync"
+    "bufio"
+    "bytes"
+    "math/bits"
+    "sync/atomic"
+)
+
+// DefaultBufferPool is a BufferPool of 64 bytes to 1 MiB buffers.
+var DefaultBufferPool = NewBufferPool(64, 1 << 20)
+
+// BufferPool recycles the buffers of PooledPackets. Buffers are sorted in
+// size classes of powers of two, so that a packet reuses a buffer at most
+// twice its size. Buffers larger than the largest class are not recycled.
+type BufferPool struct {
+    minShift    int
+    classes     []sync.Pool
+}
+
+// NewBufferPool creates a BufferPool whose size classes range from minSize
+// to maxSize, both rounded up to a power of two.
+func NewBufferPool(minSize, maxSize int) (*BufferPool) {
+    minShift := shiftFor(max(minSize, 1))
+    maxShift := max(shiftFor(maxSize), minShift)
+    bp := &BufferPool{
+        minShift:   minShift,
+        classes:    make([]sync.Pool, maxShift - minShift + 1),
+    }
+    for i := range bp.classes {
+        size := 1 << (minShift + i)
+        bp.classes[i].New = func() any {
+            return &PooledPacket{buf: make([]byte, size), pool: bp, class: i}
+        }
+    }
+    return bp
+}
+
+// shiftFor returns the smallest shift such that 1 << shift >= n.
+func shiftFor(n int) (int) {
+    if n <= 1 {
+        return 0
+    }
+    return bits.Len(uint(n - 1))
+}
+
+// Get returns a packet of n bytes, whose content is undefined. It must be
+// released once done with.
+func (bp * BufferPool) Get(n int) (*PooledPacket) {
+    class := max(shiftFor(n) - bp.minShift, 0)
+    if class >= len(bp.classes) {
+        p := &PooledPacket{buf: make([]byte, n), pool: bp, class: -1}
+        p.refs.Store(1)
+        return p
+    }
+    p := bp.classes[class].Get().(*PooledPacket)
+    p.buf = p.buf[:n]
+    p.refs.Store(1)
+    return p
+}
+
+func (bp * BufferPool) put(p *PooledPacket) {
+    if p.class >= 0 {
+        bp.classes[p.class].Put(p)
+    }
+}
+
+// Releaser is implemented by the packets holding resources, such as
+// PooledPacket. A connection releases the packets it read once they are
+// handled, that is once OnMessage returned.
+type Releaser interface {
+    Release()
+}
+
+// PooledPacket is a Packet whose buffer comes from a BufferPool. The
+// connection that read it releases it once OnMessage returns, so a handler
+// keeping it, or its bytes, longer must call Retain, then Release when done.
+type PooledPacket struct {
+    buf     []byte
+    pool  * BufferPool
+    class   int
+    refs    atomic.Int32
+}
+
+func (p * PooledPacket) Serialize() ([]byte) {
+    return p.buf
+}
+
+// Bytes returns the payload of the packet. It is only valid until the
+// packet is released.
+func (p * PooledPacket) Bytes() ([]byte) {
+    return p.buf
+}
+
+// Retain adds a reference to the packet, which must be matched by a call to
+// Release.
+func (p * PooledPacket) Retain() {
+    p.refs.Add(1)
+}
+
+// Release drops a reference to the packet, giving its buffer back to the
+// pool with the last one. The packet must not be used afterwards.
+func (p * PooledPacket) Release() {
+    if p.refs.Add(-1) == 0 {
+        p.pool.put(p)
+    }
+}
+
+// resize sets the length of the packet to n, moving its content to a larger
+// buffer if needed.
+func (p * PooledPacket) resize(n int) {
+    if n <= cap(p.buf) {
+        p.buf = p.buf[:n]
+        return
+    }
+    q := p.pool.Get(n)
+    copy(q.buf, p.buf)
+    p.buf, q.buf = q.buf, p.buf
+    p.class, q.class = q.class, p.class
+    q.Release()
+}
+
+// releasePacket releases p if it holds resources.
+func releasePacket(p Packet) {
+    if r, ok := p.(Releaser); ok {
+        r.Release()
+    }
+}
+
+// ownedBytes returns the serialization of p. If p holds resources, the bytes
+// are copied and p is released, so that they may be kept by the protocols
+// decoding the frames read by another protocol.
+func ownedBytes(p Packet) ([]byte) {
+    r, ok := p.(Releaser)
+    if !ok {
+        return p.Serialize()
+    }
+    b := bytes.Clone(p.Serialize())
+    r.Release()
+    return b
+}
+
+// ReadPooled reads a packet of n bytes from c into a buffer of pool. The
+// caller must check n against its maximum frame size, a negative n is
+// reported as ErrFrameTooLarge.
+func ReadPooled(c *Connection, pool *BufferPool, n int) (*PooledPacket, error) {
+    if n < 0 {
+        return nil, ErrFrameTooLarge
+    }
+    p := pool.Get(n)
+    if _, err := io.ReadFull(c.reader, p.buf); err != nil {
+        p.Release()
+        return nil, unexpectedEOF(err)
+    }
+    return p, nil
+}
+
+// ReadPooledDelimited reads from c into a buffer of pool up to delim, which
+// is consumed but not part of the returned packet. A maxFrameSize of 0
+// means DefaultMaxFrameSize.
+func ReadPooledDelimited(c *Connection, pool *BufferPool, delim []byte, maxFrameSize int) (*PooledPacket, error) {
+    maxFrameSize = frameSizeLimit(maxFrameSize)
+    last := delim[len(delim) - 1]
+    p := pool.Get(0)
+    for {
+        chunk, err := c.reader.ReadSlice(last)
+        n := len(p.buf)
+        p.resize(n + len(chunk))
+        copy(p.buf[n:], chunk)
+        if len(p.buf) > maxFrameSize + len(delim) {
+            p.Release()
+            return nil, ErrFrameTooLarge
+        }
+        if err == bufio.ErrBufferFull {
+            continue
+        }
+        if err != nil {
+            empty := len(p.buf) == 0
+            p.Release()
+            if empty {
+                return nil, err
+            }
+            return nil, unexpectedEOF(err)
+        }
+        if bytes.HasSuffix(p.buf, delim) {
+            break
+        }
+    }
+    p.buf = p.buf[:len(p.buf) - len(delim)]
+    if len(p.buf) > maxFrameSize {
+        p.Release()
+        return nil, ErrFrameTooLarge
+    }
+    return p, nil
+}
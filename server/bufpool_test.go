@@ -0,0 +1,231 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "time"
+    "bufio"
+    "testing"
+    "encoding/binary"
+)
+
+func TestBufferPool(t *testing.T) {
+    bp := NewBufferPool(64, 1024)
+    tests := []struct{
+        n       int
+        cap     int
+    }{
+        {0,     64},
+        {64,    64},
+        {65,    128},
+        {1000,  1024},
+        {2000,  2000},
+    }
+    for _, tt := range tests {
+        p := bp.Get(tt.n)
+        if len(p.Bytes()) != tt.n || cap(p.Bytes()) != tt.cap {
+            t.Fatal("Get(", tt.n, ") has len ", len(p.Bytes()), " cap ", cap(p.Bytes()))
+        }
+        p.Release()
+    }
+
+    p := bp.Get(10)
+    p.Retain()
+    p.Release()
+    if p.refs.Load() != 1 {
+        t.Fatal("retained packet was released")
+    }
+    p.resize(100)
+    if len(p.Bytes()) != 100 || cap(p.Bytes()) != 128 {
+        t.Fatal("resized packet has len ", len(p.Bytes()), " cap ", cap(p.Bytes()))
+    }
+    p.Release()
+}
+
+// repeatReader endlessly repeats a frame.
+type repeatReader struct {
+    frame   []byte
+    off     int
+}
+
+func (r * repeatReader) Read(b []byte) (int, error) {
+    n := 0
+    for n < len(b) {
+        c := copy(b[n:], r.frame[r.off:])
+        n += c
+        r.off = (r.off + c) % len(r.frame)
+    }
+    return n, nil
+}
+
+func TestPooledReadAllocs(t *testing.T) {
+    if raceEnabled {
+        t.Skip("the race detector makes sync.Pool drop buffers")
+    }
+    payload := make([]byte, 300)
+    frame := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+    tests := []struct{
+        name        string
+        protocol    Protocol
+        frame       []byte
+    }{
+        {"length prefix",   NewLengthPrefixProtocol(2, binary.BigEndian, 0).UseBufferPool(DefaultBufferPool), append(frame, payload...)},
+        {"varint",          NewVarintProtocol(0).UseBufferPool(DefaultBufferPool), append(binary.AppendUvarint(nil, 300), payload...)},
+        {"line",            NewLineProtocol(0).UseBufferPool(DefaultBufferPool), append(make([]byte, 5000), "\r\n"...)},
+    }
+    for _, tt := range tests {
+        c := NewConnection(nil, nil)
+        c.reader = bufio.NewReader(&repeatReader{frame: tt.frame})
+        allocs := testing.AllocsPerRun(100, func() {
+            p, err := tt.protocol.ReadPacket(c)
+            if err != nil {
+                t.Fatal(err)
+            }
+            releasePacket(p)
+        })
+        if allocs != 0 {
+            t.Fatal(tt.name, ": ", allocs, " allocations per packet")
+        }
+    }
+}
+
+// framesConn serves left bytes of repeated frames, then EOF.
+type framesConn struct {
+    net.Conn
+    r       repeatReader
+    left    int
+}
+
+func (c * framesConn) Read(b []byte) (int, error) {
+    if c.left <= 0 {
+        return 0, io.EOF
+    }
+    n, _ := c.r.Read(b[:min(len(b), c.left)])
+    c.left -= n
+    return n, nil
+}
+
+func TestConnectionLoopAllocs(t *testing.T) {
+    if raceEnabled {
+        t.Skip("the race detector makes sync.Pool drop buffers")
+    }
+    const packets = 1000
+    payload := make([]byte, 300)
+    frame := append(binary.BigEndian.AppendUint16(nil, uint16(len(payload))), payload...)
+    h := &HandlerFuncs{Message: func(*Connection, Packet) bool { return true }}
+    s := NewServer("127.0.0.1:0", h, NewLengthPrefixProtocol(2, binary.BigEndian, 0).UseBufferPool(DefaultBufferPool))
+    defer s.Stop()
+    fc := &framesConn{r: repeatReader{frame: frame}}
+    c := NewConnection(s, fc)
+
+    allocs := testing.AllocsPerRun(10, func() {
+        fc.left = packets * len(frame)
+        c.reader.Reset(connIO{fc, c})
+        if reason, err := c.handleRead(); reason != ClosePeerEOF {
+            t.Fatal(reason, err)
+        }
+    })
+    if allocs / packets > 0.01 {
+        t.Fatal(allocs / packets, " allocations per packet")
+    }
+}
+
+// recordingProtocol remembers the last pooled packet read by its framing.
+type recordingProtocol struct {
+    Protocol
+    last  * PooledPacket
+}
+
+func (p * recordingProtocol) ReadPacket(c *Connection) (Packet, error) {
+    packet, err := p.Protocol.ReadPacket(c)
+    p.last, _ = packet.(*PooledPacket)
+    return packet, err
+}
+
+func TestWrappersReleasePooledFrames(t *testing.T) {
+    registry := NewRegistry()
+    registry.Register("chat", ChatMessage{})
+    framing := &recordingProtocol{Protocol: NewVarintProtocol(0).UseBufferPool(NewBufferPool(16, 1024))}
+    codec := NewCodecProtocol(framing, JSONCodec{}, registry)
+    rpc := NewRPCProtocol(framing)
+
+    encoder := NewCodecProtocol(NewVarintProtocol(0), JSONCodec{}, registry)
+    m, err := encoder.NewMessage(ChatMessage{From: "alice", Text: "hi"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    message, _ := encoder.EncodePacket(m)
+    request, _ := NewVarintProtocol(0).EncodePacket(&RPCPacket{kind: rpcRequest, ID: 1, Method: "add", Payload: []byte("{}")})
+
+    for _, tt := range []struct{
+        name        string
+        protocol    Protocol
+        stream      []byte
+    }{
+        {"codec",   codec,  message},
+        {"rpc",     rpc,    request},
+    } {
+        packets, err := readFrames(t, tt.protocol, tt.stream, 1)
+        if err != nil {
+            t.Fatal(tt.name, ": ", err)
+        }
+        if framing.last == nil || framing.last.refs.Load() != 0 {
+            t.Fatal(tt.name, ": pooled frame was not released")
+        }
+        switch p := packets[0].(type) {
+        case *Message:
+            if chat := p.Value.(*ChatMessage); chat.Text != "hi" {
+                t.Fatal(tt.name, ": ", chat)
+            }
+        case *RPCPacket:
+            if p.Method != "add" || string(p.Payload) != "{}" {
+                t.Fatal(tt.name, ": ", p.Method, " ", string(p.Payload))
+            }
+        }
+    }
+}
+
+func TestPooledEcho(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64).UseBufferPool(NewBufferPool(16, 64)),
+        WithSendQueue(8, OverflowBlock))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.Write([]byte("one\r\ntwo\nthree\n"))
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    r := bufio.NewReader(conn)
+    for _, want := range []string{"one\n", "two\n", "three\n"} {
+        line, err := r.ReadString('\n')
+        if err != nil && err != io.EOF {
+            t.Fatal(err)
+        }
+        if line != want {
+            t.Fatal(line, " != ", want)
+        }
+    }
+}
@@ -0,0 +1,285 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "crypto/tls"
+    "math/rand/v2"
+)
+
+var(
+    ErrNotConnected = errors.New("client is not connected")
+)
+
+// ClientOption configures a Client created by NewClient.
+type ClientOption func(*Client)
+
+// Client is the dialing counterpart of Server: it runs an outbound
+// connection with the same Protocol and ConnectionHandler semantics, and can
+// reconnect automatically when the connection is lost.
+type Client struct {
+    connOptions
+    addr            string
+    handler         ConnectionHandler
+    protocol        Protocol
+
+    tlsConfig     * tls.Config
+    dialTimeout     time.Duration
+    reconnect       bool
+    minBackoff      time.Duration
+    maxBackoff      time.Duration
+    onConnect       func(*Connection)
+    onDisconnect    func(*Connection)
+
+    mutex           sync.Mutex
+    conn          * Connection
+    connected       chan struct{}
+    done            chan struct{}
+    closeOnce       sync.Once
+    waitGroup       sync.WaitGroup
+}
+
+// WithClientTLS makes the client speak TLS using config.
+func WithClientTLS(config *tls.Config) (ClientOption) {
+    return func(cl *Client) {
+        cl.tlsConfig = config
+    }
+}
+
+// WithDialTimeout bounds each connection attempt. Defaults to 10 seconds.
+func WithDialTimeout(d time.Duration) (ClientOption) {
+    return func(cl *Client) {
+        cl.dialTimeout = d
+    }
+}
+
+// minReconnectBackoff is the shortest backoff of a reconnecting client.
+const minReconnectBackoff = 100 * time.Millisecond
+
+// WithReconnect makes the client reconnect whenever the connection fails or
+// is lost. Attempts are spaced by an exponential backoff starting at first
+// and capped at limit, with random jitter. Both are raised to at least
+// 100ms, so that a server down is not redialed in a tight loop.
+func WithReconnect(first, limit time.Duration) (ClientOption) {
+    return func(cl *Client) {
+        cl.reconnect = true
+        cl.minBackoff = max(first, minReconnectBackoff)
+        cl.maxBackoff = max(limit, cl.minBackoff)
+    }
+}
+
+// WithOnConnect sets a callback invoked each time a connection is
+// established, before OnAccept.
+func WithOnConnect(fn func(*Connection)) (ClientOption) {
+    return func(cl *Client) {
+        cl.onConnect = fn
+    }
+}
+
+// WithOnDisconnect sets a callback invoked each time an established
+// connection ends, after OnClose.
+func WithOnDisconnect(fn func(*Connection)) (ClientOption) {
+    return func(cl *Client) {
+        cl.onDisconnect = fn
+    }
+}
+
+// WithClientHeartbeat is the client side counterpart of WithHeartbeat.
+func WithClientHeartbeat(interval time.Duration, misses int) (ClientOption) {
+    return func(cl *Client) {
+        cl.heartbeatInterval = interval
+        cl.heartbeatMisses = misses
+    }
+}
+
+func NewClient(addr string, handler ConnectionHandler, protocol Protocol, opts ...ClientOption) (*Client) {
+    cl := &Client{
+        addr:           addr,
+        handler:        handler,
+        protocol:       protocol,
+        dialTimeout:    10 * time.Second,
+        connected:      make(chan struct{}),
+        done:           make(chan struct{}),
+    }
+    cl.handshakeTimeout = 10 * time.Second
+    for _, opt := range opts {
+        opt(cl)
+    }
+    return cl
+}
+
+// Start dials the server and runs the connection in the background. Without
+// reconnection, the error of the first attempt is returned; with it, failed
+// attempts are retried in the background and Start returns nil.
+func (cl * Client) Start() (error) {
+    conn, err := cl.dial()
+    if err != nil && !cl.reconnect {
+        return err
+    }
+    cl.waitGroup.Add(1)
+    go cl.run(conn)
+    return nil
+}
+
+// Close stops reconnecting, closes the current connection and waits for the
+// client to terminate.
+func (cl * Client) Close() {
+    cl.closeOnce.Do(func() {
+        close(cl.done)
+    })
+    if c := cl.Conn(); c != nil {
+        c.Close()
+    }
+    cl.waitGroup.Wait()
+}
+
+// Conn returns the current connection, or nil if the client is not
+// connected.
+func (cl * Client) Conn() (*Connection) {
+    cl.mutex.Lock()
+    defer cl.mutex.Unlock()
+    return cl.conn
+}
+
+// WaitConnected blocks until the client is connected or ctx expires.
+func (cl * Client) WaitConnected(ctx context.Context) (*Connection, error) {
+    for {
+        cl.mutex.Lock()
+        c, connected := cl.conn, cl.connected
+        cl.mutex.Unlock()
+        if c != nil {
+            return c, nil
+        }
+        select {
+        case <-connected:
+        case <-cl.done:
+            return nil, ErrClosed
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Send sends p on the current connection.
+func (cl * Client) Send(p Packet) (error) {
+    c := cl.Conn()
+    if c == nil {
+        return ErrNotConnected
+    }
+    return c.Send(p)
+}
+
+func (cl * Client) dial() (net.Conn, error) {
+    dialer := &net.Dialer{Timeout: cl.dialTimeout}
+    conn, err := dialer.Dial("tcp", cl.addr)
+    if err != nil {
+        return nil, err
+    }
+    if cl.tlsConfig != nil {
+        config := cl.tlsConfig
+        if config.ServerName == "" {
+            config = config.Clone()
+            config.ServerName, _, _ = net.SplitHostPort(cl.addr)
+        }
+        conn = tls.Client(conn, config)
+    }
+    return conn, nil
+}
+
+func (cl * Client) run(conn net.Conn) {
+    defer cl.waitGroup.Done()
+    attempt := 0
+    for {
+        if conn != nil {
+            attempt = 0
+            cl.serve(conn)
+            conn = nil
+        }
+        if !cl.reconnect || !cl.sleep(cl.backoff(attempt)) {
+            return
+        }
+        attempt++
+        var err error
+        if conn, err = cl.dial(); err != nil {
+            conn = nil
+        }
+    }
+}
+
+func (cl * Client) serve(conn net.Conn) {
+    c := newConnection(context.Background(), conn, cl.handler, cl.protocol, &cl.connOptions)
+    cl.mutex.Lock()
+    select {
+    case <-cl.done:
+        cl.mutex.Unlock()
+        conn.Close()
+        return
+    default:
+    }
+    cl.conn = c
+    close(cl.connected)
+    cl.mutex.Unlock()
+
+    if cl.onConnect != nil {
+        cl.onConnect(c)
+    }
+    c.serve()
+
+    cl.mutex.Lock()
+    cl.conn = nil
+    cl.connected = make(chan struct{})
+    cl.mutex.Unlock()
+    if cl.onDisconnect != nil {
+        cl.onDisconnect(c)
+    }
+}
+
+// backoff returns the delay before the attempt-th reconnection: an
+// exponential delay capped at maxBackoff, of which a random half is jitter.
+func (cl * Client) backoff(attempt int) (time.Duration) {
+    d := cl.minBackoff
+    for i := 0; i < attempt && d < cl.maxBackoff; i++ {
+        d *= 2
+    }
+    if cl.maxBackoff > 0 && d > cl.maxBackoff {
+        d = cl.maxBackoff
+    }
+    if d <= 0 {
+        return 0
+    }
+    return d / 2 + rand.N(d / 2 + 1)
+}
+
+func (cl * Client) sleep(d time.Duration) (bool) {
+    t := time.NewTimer(d)
+    defer t.Stop()
+    select {
+    case <-t.C:
+        return true
+    case <-cl.done:
+        return false
+    }
+}
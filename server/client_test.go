@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "time"
+    "context"
+    "testing"
+)
+
+type EchoHandler struct {
+    ShutdownAwareHandler
+}
+
+func (h * EchoHandler) OnMessage(c *Connection, p Packet) bool {
+    c.Send(p)
+    return true
+}
+
+type ClientHandler struct {
+    messages chan string
+}
+
+func (h * ClientHandler) OnAccept(c *Connection) bool {
+    return true
+}
+
+func (h * ClientHandler) OnMessage(c *Connection, p Packet) bool {
+    h.messages <- string(p.Serialize())
+    return true
+}
+
+func (h * ClientHandler) OnTimeout(c *Connection) bool {
+    return true
+}
+
+func (h * ClientHandler) OnClose(c *Connection) {
+}
+
+func TestClientReconnect(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(0))
+    addr := startServer(t, s)
+
+    connects := make(chan *Connection, 4)
+    disconnects := make(chan *Connection, 4)
+    h := &ClientHandler{messages: make(chan string, 4)}
+    cl := NewClient(addr.String(), h, NewLineProtocol(0),
+        WithReconnect(time.Millisecond * 100, time.Millisecond * 200),
+        WithOnConnect(func(c *Connection) { connects <- c }),
+        WithOnDisconnect(func(c *Connection) { disconnects <- c }))
+    if err := cl.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer cl.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
+    defer cancel()
+
+    expect := func(message string) {
+        if err := cl.Send(RawPacket(message)); err != nil {
+            t.Fatal(err)
+        }
+        select {
+        case m := <-h.messages:
+            if m != message {
+                t.Fatal(m, " != ", message)
+            }
+        case <-ctx.Done():
+            t.Fatal("no echo for ", message)
+        }
+    }
+
+    first, err := cl.WaitConnected(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expect("hello")
+
+    s.Stop()
+    select {
+    case c := <-disconnects:
+        if c != first {
+            t.Fatal("unexpected disconnected connection")
+        }
+    case <-ctx.Done():
+        t.Fatal("disconnection not reported")
+    }
+
+    s = NewServer(addr.String(), &EchoHandler{}, NewLineProtocol(0))
+    startServer(t, s)
+    defer s.Stop()
+
+    <-connects
+    select {
+    case c := <-connects:
+        if c == first {
+            t.Fatal("connection was not renewed")
+        }
+    case <-ctx.Done():
+        t.Fatal("client did not reconnect")
+    }
+    if _, err = cl.WaitConnected(ctx); err != nil {
+        t.Fatal(err)
+    }
+    expect("again")
+}
+
+func TestClientWithoutReconnect(t *testing.T) {
+    cl := NewClient("127.0.0.1:1", &ClientHandler{}, NewLineProtocol(0))
+    if err := cl.Start(); err == nil {
+        cl.Close()
+        t.Fatal("dialing a closed port succeeded")
+    }
+    if err := cl.Send(RawPacket("x")); err != ErrNotConnected {
+        t.Fatal(err)
+    }
+}
+
+func TestClientBackoffFloor(t *testing.T) {
+    cl := NewClient("127.0.0.1:1", &ClientHandler{}, NewLineProtocol(0), WithReconnect(0, 0))
+    for attempt := 0; attempt < 4; attempt++ {
+        if d := cl.backoff(attempt); d < minReconnectBackoff / 2 {
+            t.Fatal("attempt ", attempt, ": backoff ", d, " below floor")
+        }
+    }
+}
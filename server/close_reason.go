@@ -0,0 +1,98 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "errors"
+)
+
+var(
+    ErrRejected = errors.New("connection rejected by handler")
+    ErrShutdown = errors.New("server shutting down")
+)
+
+// CloseReason tells why a connection was closed. It is available through
+// Connection.CloseReason from OnClose on.
+type CloseReason int
+
+const(
+    // CloseNone is the reason of a connection still open.
+    CloseNone CloseReason = iota
+    // CloseExplicit means Close was called.
+    CloseExplicit
+    // ClosePeerEOF means the peer closed the connection.
+    ClosePeerEOF
+    // CloseReadError means reading from the network failed.
+    CloseReadError
+    // CloseProtocolError means the protocol failed to read a packet, or
+    // the TLS handshake failed.
+    CloseProtocolError
+    // CloseTimeout means a timeout fired and was not kept by OnTimeout.
+    CloseTimeout
+    // CloseRejected means OnAccept or OnMessage returned false.
+    CloseRejected
+    // CloseShutdown means the server force-closed the connection while
+    // shutting down.
+    CloseShutdown
+    // CloseWriteError means writing to the peer failed, or the peer was
+    // too slow to drain its send queue.
+    CloseWriteError
+    // CloseHeartbeat means the peer stopped answering heartbeats.
+    CloseHeartbeat
+    // CloseRateLimited means the peer exceeded its message rate.
+    CloseRateLimited
+)
+
+func (r CloseReason) String() (string) {
+    switch r {
+    case CloseNone:
+        return "none"
+    case CloseExplicit:
+        return "explicit close"
+    case ClosePeerEOF:
+        return "peer closed"
+    case CloseReadError:
+        return "read error"
+    case CloseProtocolError:
+        return "protocol error"
+    case CloseTimeout:
+        return "timeout"
+    case CloseRejected:
+        return "rejected by handler"
+    case CloseShutdown:
+        return "server shutdown"
+    case CloseWriteError:
+        return "write error"
+    case CloseHeartbeat:
+        return "heartbeat timeout"
+    case CloseRateLimited:
+        return "rate limited"
+    }
+    return "unknown"
+}
+
+func readCloseReason(err error) (CloseReason) {
+    if errors.Is(err, io.EOF) || errors.Is(err, EOF) {
+        return ClosePeerEOF
+    }
+    return CloseReadError
+}
@@ -0,0 +1,146 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "context"
+    "time"
+    "testing"
+)
+
+type closeEvent struct {
+    conn   *Connection
+    reason  CloseReason
+    err     error
+}
+
+type ReasonHandler struct {
+    EchoHandler
+    events chan closeEvent
+}
+
+func (h * ReasonHandler) OnMessage(c *Connection, p Packet) bool {
+    if string(p.Serialize()) == "close" {
+        c.Close()
+    }
+    return string(p.Serialize()) != "quit"
+}
+
+func (h * ReasonHandler) OnClose(c *Connection) {
+    h.events <- closeEvent{c, c.CloseReason(), c.Err()}
+}
+
+func TestCloseReasons(t *testing.T) {
+    h := &ReasonHandler{events: make(chan closeEvent, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(8),
+        WithIdleTimeout(time.Millisecond * 50))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    tests := []struct{
+        send    string
+        reason  CloseReason
+        err     error
+    }{
+        {"",                    ClosePeerEOF,       io.EOF},
+        {"quit\n",              CloseRejected,      ErrRejected},
+        {"far too long\n",      CloseProtocolError, ErrFrameTooLarge},
+        {"close\n",             CloseExplicit,      nil},
+        {"",                    CloseTimeout,       nil},
+    }
+    for _, tt := range tests {
+        conn, err := net.Dial("tcp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if tt.reason == ClosePeerEOF {
+            conn.Close()
+        } else {
+            conn.Write([]byte(tt.send))
+            defer conn.Close()
+        }
+        select {
+        case ev := <-h.events:
+            if tt.reason == CloseTimeout && isTimeout(ev.err) {
+                ev.err = nil
+            }
+            if ev.reason != tt.reason || ev.err != tt.err {
+                t.Fatal(ev.reason, ", ", ev.err, " != ", tt.reason, ", ", tt.err)
+            }
+            if !ev.conn.IsClosed() {
+                t.Fatal("closed connection reports being open")
+            }
+        case <-time.After(time.Second):
+            t.Fatal("connection was not closed for ", tt.reason)
+        }
+    }
+}
+
+func TestCloseReasonWriteError(t *testing.T) {
+    h := &ReasonHandler{events: make(chan closeEvent, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(8))
+    local, remote := net.Pipe()
+    c := NewConnection(s, local)
+    remote.Close()
+
+    if err := c.Send(RawPacket("lost")); err == nil {
+        t.Fatal("write to a closed peer succeeded")
+    }
+    select {
+    case ev := <-h.events:
+        if ev.reason != CloseWriteError || ev.err != io.ErrClosedPipe {
+            t.Fatal(ev.reason, ", ", ev.err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("connection was not closed on write error")
+    }
+}
+
+func TestCloseReasonShutdown(t *testing.T) {
+    events := make(chan closeEvent, 1)
+    h := &HandlerFuncs{Next: &Handler{t}, Close: func(c *Connection) {
+        events <- closeEvent{c, c.CloseReason(), c.Err()}
+    }}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(8))
+    addr := startServer(t, s)
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    for len(s.Connections()) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    s.Shutdown(ctx)
+    select {
+    case ev := <-events:
+        if ev.reason != CloseShutdown || ev.err != ErrShutdown {
+            t.Fatal(ev.reason, ", ", ev.err)
+        }
+    default:
+        t.Fatal("connection was not closed by shutdown")
+    }
+}
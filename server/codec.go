@@ -0,0 +1,215 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "fmt"
+    "sync"
+    "bytes"
+    "errors"
+    "reflect"
+    "encoding/gob"
+    "encoding/json"
+    "encoding/binary"
+)
+
+var(
+    ErrUnknownMessageType = errors.New("unknown message type")
+    ErrMalformedMessage   = errors.New("malformed message")
+)
+
+// Codec turns Go values into bytes and back.
+type Codec interface {
+    Marshal(v any) ([]byte, error)
+    Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec is a Codec using encoding/json.
+type JSONCodec struct {}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) (error) {
+    return json.Unmarshal(data, v)
+}
+
+// GobCodec is a Codec using encoding/gob. Every message carries its own type
+// description, so messages can be decoded independently of each other.
+type GobCodec struct {}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+    var b bytes.Buffer
+    if err := gob.NewEncoder(&b).Encode(v); err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) (error) {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Registry maps message type tags to Go types.
+type Registry struct {
+    mutex       sync.RWMutex
+    types       map[string]reflect.Type
+    tags        map[reflect.Type]string
+}
+
+func NewRegistry() (*Registry) {
+    return &Registry{
+        types: make(map[string]reflect.Type),
+        tags:  make(map[reflect.Type]string),
+    }
+}
+
+// Register associates tag with the type of v. Values of that type, or
+// pointers to it, are sent with that tag, and received messages carrying
+// that tag are decoded into a pointer to a new value of that type.
+func (r * Registry) Register(tag string, v any) (error) {
+    t := reflect.TypeOf(v)
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if t == nil {
+        return fmt.Errorf("server: cannot register nil for %q", tag)
+    }
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if _, ok := r.types[tag]; ok {
+        return fmt.Errorf("server: message type %q already registered", tag)
+    }
+    if other, ok := r.tags[t]; ok {
+        return fmt.Errorf("server: %s already registered as %q", t, other)
+    }
+    r.types[tag] = t
+    r.tags[t] = tag
+    return nil
+}
+
+// Tag returns the tag registered for the type of v.
+func (r * Registry) Tag(v any) (string, bool) {
+    t := reflect.TypeOf(v)
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    tag, ok := r.tags[t]
+    return tag, ok
+}
+
+// New returns a pointer to a new value of the type registered for tag.
+func (r * Registry) New(tag string) (any, bool) {
+    r.mutex.RLock()
+    t, ok := r.types[tag]
+    r.mutex.RUnlock()
+    if !ok {
+        return nil, false
+    }
+    return reflect.New(t).Interface(), true
+}
+
+// Message is the Packet exchanged by a CodecProtocol. Value holds a pointer
+// to the decoded Go value and Type the tag it was registered with.
+type Message struct {
+    Type        string
+    Value       any
+    data        []byte
+}
+
+func (m * Message) Serialize() ([]byte) {
+    return m.data
+}
+
+// CodecProtocol sits between a framing protocol and the handler: every
+// frame carries a type tag followed by a value encoded with a Codec, and is
+// delivered to OnMessage as a *Message holding the decoded value.
+type CodecProtocol struct {
+    framing     Protocol
+    codec       Codec
+    registry  * Registry
+}
+
+func NewCodecProtocol(framing Protocol, codec Codec, registry *Registry) (*CodecProtocol) {
+    return &CodecProtocol{
+        framing:    framing,
+        codec:      codec,
+        registry:   registry,
+    }
+}
+
+func (p * CodecProtocol) ReadPacket(c *Connection) (Packet, error) {
+    frame, err := p.framing.ReadPacket(c)
+    if err != nil {
+        return nil, err
+    }
+    data := ownedBytes(frame)
+    n, k := binary.Uvarint(data)
+    if k <= 0 || uint64(len(data) - k) < n {
+        return nil, ErrMalformedMessage
+    }
+    tag := string(data[k:k + int(n)])
+    v, ok := p.registry.New(tag)
+    if !ok {
+        return nil, fmt.Errorf("%w: %q", ErrUnknownMessageType, tag)
+    }
+    if err = p.codec.Unmarshal(data[k + int(n):], v); err != nil {
+        return nil, err
+    }
+    return &Message{Type: tag, Value: v, data: data}, nil
+}
+
+// NewMessage encodes v, whose type must have been registered, into a
+// Message ready to be sent.
+func (p * CodecProtocol) NewMessage(v any) (*Message, error) {
+    tag, ok := p.registry.Tag(v)
+    if !ok {
+        return nil, fmt.Errorf("%w: %T", ErrUnknownMessageType, v)
+    }
+    payload, err := p.codec.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    data := make([]byte, 0, binary.MaxVarintLen64 + len(tag) + len(payload))
+    data = binary.AppendUvarint(data, uint64(len(tag)))
+    data = append(data, tag...)
+    data = append(data, payload...)
+    return &Message{Type: tag, Value: v, data: data}, nil
+}
+
+// Send encodes v and sends it on c.
+func (p * CodecProtocol) Send(c *Connection, v any) (error) {
+    m, err := p.NewMessage(v)
+    if err != nil {
+        return err
+    }
+    return c.Send(m)
+}
+
+func (p * CodecProtocol) EncodePacket(packet Packet) ([]byte, error) {
+    if enc, ok := p.framing.(PacketEncoder); ok {
+        return enc.EncodePacket(packet)
+    }
+    return packet.Serialize(), nil
+}
@@ -0,0 +1,154 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "bytes"
+    "errors"
+    "net"
+    "reflect"
+    "testing"
+)
+
+type ChatMessage struct {
+    From        string
+    Text        string              `msgpack:"text"`
+    Tags        []string            `msgpack:",omitempty"`
+    Meta        map[string]int
+    Priority    int8
+    Score       float64
+    Raw         []byte
+    Reply      *ChatMessage
+    Hidden      string              `msgpack:"-"`
+}
+
+type JoinMessage struct {
+    Room        string
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+    in := ChatMessage{
+        From:       "alice",
+        Text:       string(make([]byte, 300)),
+        Meta:       map[string]int{"a": -1, "b": 70000, "c": -40000},
+        Priority:   -100,
+        Score:      3.25,
+        Raw:        []byte{1, 2, 3},
+        Reply:      &ChatMessage{From: "bob", Tags: []string{"x"}},
+        Hidden:     "secret",
+    }
+    b, err := MsgpackCodec{}.Marshal(in)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var out ChatMessage
+    if err = (MsgpackCodec{}).Unmarshal(b, &out); err != nil {
+        t.Fatal(err)
+    }
+    in.Hidden = ""
+    if !reflect.DeepEqual(in, out) {
+        t.Fatalf("%+v != %+v", in, out)
+    }
+
+    var generic any
+    if err = (MsgpackCodec{}).Unmarshal(b, &generic); err != nil {
+        t.Fatal(err)
+    }
+    if m, ok := generic.(map[string]any); !ok || m["From"] != "alice" {
+        t.Fatalf("%#v", generic)
+    }
+
+    var small struct{ Priority uint8 }
+    if err = (MsgpackCodec{}).Unmarshal(b, &small); err == nil {
+        t.Fatal("negative value decoded into an unsigned field")
+    }
+}
+
+func TestMsgpackMaxDepth(t *testing.T) {
+    for name, level := range map[string][]byte{
+        "array":    {0x91},
+        "map":      {0x81, 0xc0},
+    } {
+        data := append(bytes.Repeat(level, msgpackMaxDepth + 1), 0xc0)
+        var v any
+        if err := (MsgpackCodec{}).Unmarshal(data, &v); !errors.Is(err, errMsgpackDepth) {
+            t.Fatal(name, ": ", err)
+        }
+    }
+
+    data := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth), 0xc0)
+    var v any
+    if err := (MsgpackCodec{}).Unmarshal(data, &v); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCodecProtocol(t *testing.T) {
+    registry := NewRegistry()
+    registry.Register("chat", ChatMessage{})
+    registry.Register("join", &JoinMessage{})
+    if err := registry.Register("join", ChatMessage{}); err == nil {
+        t.Fatal("duplicate tag was registered")
+    }
+
+    codecs := map[string]Codec{
+        "json":     JSONCodec{},
+        "gob":      GobCodec{},
+        "msgpack":  MsgpackCodec{},
+    }
+    for name, codec := range codecs {
+        p := NewCodecProtocol(NewVarintProtocol(0), codec, registry)
+        local, remote := net.Pipe()
+        go func() {
+            for _, v := range []any{&JoinMessage{Room: "go"}, ChatMessage{From: "alice", Text: "hi"}} {
+                m, err := p.NewMessage(v)
+                if err != nil {
+                    t.Error(name, ": ", err)
+                }
+                b, _ := p.EncodePacket(m)
+                remote.Write(b)
+            }
+        }()
+
+        c := NewConnection(nil, local)
+        packet, err := p.ReadPacket(c)
+        if err != nil {
+            t.Fatal(name, ": ", err)
+        }
+        if join, ok := packet.(*Message).Value.(*JoinMessage); !ok || join.Room != "go" {
+            t.Fatalf("%s: %#v", name, packet)
+        }
+        packet, err = p.ReadPacket(c)
+        if err != nil {
+            t.Fatal(name, ": ", err)
+        }
+        m := packet.(*Message)
+        if chat, ok := m.Value.(*ChatMessage); m.Type != "chat" || !ok || chat.Text != "hi" {
+            t.Fatalf("%s: %#v", name, m)
+        }
+        local.Close()
+        remote.Close()
+    }
+
+    if _, err := NewCodecProtocol(NewVarintProtocol(0), JSONCodec{}, registry).NewMessage(42); err == nil {
+        t.Fatal("unregistered type was encoded")
+    }
+}
@@ -23,42 +23,167 @@ import(
     "net"
     "bufio"
     "sync"
+    "sync/atomic"
     "time"
     "crypto/tls"
+    "crypto/x509"
     "errors"
+    "context"
+    "net/netip"
+    "github.com/kdruelle/gutils/trace"
 )
 
 var(
     EOF = errors.New("End of file")
 )
 
+// connOptions holds the settings shared by the connections of a Server or
+// of a Client.
+type connOptions struct {
+    handshakeTimeout time.Duration
+    idleTimeout      time.Duration
+    readTimeout      time.Duration
+    writeTimeout     time.Duration
+    sendQueueDepth   int
+    sendPolicy       OverflowPolicy
+    heartbeatInterval time.Duration
+    heartbeatMisses  int
+}
+
+// TimeoutKind tells which timeout fired when OnTimeout is called.
+type TimeoutKind int
+
+const(
+    // TimeoutIdle fires when no packet started within the idle timeout, or
+    // within a deadline set by the handler. The connection is kept if
+    // OnTimeout returns true.
+    TimeoutIdle TimeoutKind = iota
+    // TimeoutRead fires when a packet was not read entirely within the
+    // read timeout. The connection is always closed.
+    TimeoutRead
+    // TimeoutWrite fires when a write did not complete within the write
+    // timeout. The connection is always closed.
+    TimeoutWrite
+)
+
+func (k TimeoutKind) String() (string) {
+    switch k {
+    case TimeoutIdle:
+        return "idle"
+    case TimeoutRead:
+        return "read"
+    case TimeoutWrite:
+        return "write"
+    }
+    return "unknown"
+}
+
+func isTimeout(err error) (bool) {
+    var nerr net.Error
+    return errors.As(err, &nerr) && nerr.Timeout()
+}
+
 type Connection struct {
+    id          uint64
     conn        net.Conn
     server      *Server
+    listener    *Listener
+    handler     ConnectionHandler
+    protocol    Protocol
+    opts        *connOptions
+    accepted    atomic.Bool
+    notified    atomic.Bool
+    datagram    bool
+    timeoutKind atomic.Int32
     
     reader      *bufio.Reader
     writer      *bufio.Writer
+    writeMutex  sync.Mutex
+    sendQueue   chan []byte
+    sendPolicy  OverflowPolicy
+    writeDone   chan struct{}
 
     closeOnce   sync.Once
     closeChan   chan bool
+    errMutex    sync.Mutex
+    err         error
+    reason      CloseReason
+    ctx         context.Context
+    cancel      context.CancelCauseFunc
+    traceCtx    context.Context
+
+    attrMutex   sync.RWMutex
+    attrs       map[any]any
+
+    proxy       *ProxyHeader
+    remoteIP    netip.Addr
+    messages    *tokenBucket
+
+    created     time.Time
+    io          ioCounters
+    metrics     *serverMetrics
+
+    rtt         atomic.Int64
+    pingSent    atomic.Int64
+    missedPings atomic.Int32
 }
 
 func NewConnection(s * Server, c net.Conn) (*Connection) {
+    if s == nil {
+        return newConnection(context.Background(), c, nil, nil, &connOptions{})
+    }
+    return newServerConnection(context.Background(), s, c)
+}
+
+func newServerConnection(ctx context.Context, s * Server, c net.Conn) (*Connection) {
+    conn := newConnection(ctx, c, s.handler, s.protocol, &s.connOptions)
+    conn.server = s
+    conn.metrics = &s.metrics
+    return conn
+}
+
+func newConnection(ctx context.Context, c net.Conn, handler ConnectionHandler, protocol Protocol, opts *connOptions) (*Connection) {
     conn := &Connection {
         conn:       c,
-        server:     s,
+        handler:    handler,
+        protocol:   protocol,
+        opts:       opts,
         closeChan:  make(chan bool),
     }
-    conn.reader = bufio.NewReader(conn.conn)
-    conn.writer = bufio.NewWriter(conn.conn)
+    conn.ctx, conn.cancel = context.WithCancelCause(ctx)
+    conn.created = time.Now()
+    conn.resetIO(defaultBufferSize)
     return conn
 }
 
+// resetIO sets up the buffered reader and writer of the connection over its
+// current net.Conn. Any buffered data is lost.
+func (c * Connection) resetIO(size int) {
+    rw := connIO{c.conn, c}
+    c.reader = bufio.NewReaderSize(rw, size)
+    c.writer = bufio.NewWriterSize(rw, size)
+}
+
 func (c * Connection) Read(b []byte) (n int, err error) {
     return c.reader.Read(b)
 }
 
+// ID returns the identifier the server assigned to the connection. IDs are
+// unique for the lifetime of a Server.
+func (c * Connection) ID() (uint64) {
+    return c.id
+}
+
+// Write writes b to the peer and flushes it. A failed write closes the
+// connection with CloseWriteError, or CloseTimeout if the write timeout
+// fired.
 func (c * Connection) Write(b []byte) (n int, err error) {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    c.armWriteDeadline()
+    defer func() {
+        c.checkWriteError(err)
+    }()
     n, err = c.writer.Write(b)
     if err != nil {
         return
@@ -67,15 +192,60 @@ func (c * Connection) Write(b []byte) (n int, err error) {
     return
 }
 
+// Close closes the connection with the CloseExplicit reason. Packets still
+// in the send queue are written first, see EnableSendQueue.
 func (c * Connection) Close() {
+    c.closeWith(CloseExplicit, nil)
+}
+
+// closeWith closes the connection, recording reason and err as the cause of
+// the close if it was still open.
+func (c * Connection) closeWith(reason CloseReason, err error) {
     c.closeOnce.Do(func(){
+        c.errMutex.Lock()
+        c.reason = reason
+        c.err = err
+        c.errMutex.Unlock()
         close(c.closeChan)
-        c.server.handler.OnClose(c)
+        if err == nil {
+            err = ErrClosed
+        }
+        c.cancel(err)
+        if c.writeDone != nil && drainsQueue(reason) {
+            timeout := c.opts.writeTimeout
+            if timeout <= 0 {
+                timeout = drainTimeout
+            }
+            c.conn.SetWriteDeadline(time.Now().Add(timeout))
+            <-c.writeDone
+        }
+        c.handler.OnClose(c)
         c.conn.Close()
     })
 }
 
+// Err returns the error that terminated the connection, or nil while it is
+// open or if it was closed without error.
+func (c * Connection) Err() (error) {
+    c.errMutex.Lock()
+    defer c.errMutex.Unlock()
+    return c.err
+}
+
+// CloseReason returns why the connection was closed, or CloseNone while it
+// is open. It is set when OnClose is called.
+func (c * Connection) CloseReason() (CloseReason) {
+    c.errMutex.Lock()
+    defer c.errMutex.Unlock()
+    return c.reason
+}
+
 func (c * Connection) IsClosed() (bool) {
+    select {
+    case <-c.closeChan:
+        return true
+    default:
+    }
     return false
 }
 
@@ -95,6 +265,57 @@ func (c * Connection) SetDeadline(t time.Time) (err error) {
     return
 }
 
+func (c * Connection) armWriteDeadline() {
+    if c.opts.writeTimeout > 0 {
+        c.conn.SetWriteDeadline(time.Now().Add(c.opts.writeTimeout))
+    }
+}
+
+// checkWriteError closes the connection after a failed write, as the peer
+// may have received a partial packet. A write timeout is reported to
+// OnTimeout first. The close is deferred to another goroutine since the
+// writer lock is held.
+func (c * Connection) checkWriteError(err error) {
+    if err == nil || c.IsClosed() {
+        return
+    }
+    go func() {
+        if c.opts.writeTimeout > 0 && isTimeout(err) {
+            c.onTimeout(TimeoutWrite)
+            c.closeWith(CloseTimeout, err)
+            return
+        }
+        c.closeWith(CloseWriteError, err)
+    }()
+}
+
+// TimeoutKind returns the kind of the timeout being reported to OnTimeout.
+func (c * Connection) TimeoutKind() (TimeoutKind) {
+    return TimeoutKind(c.timeoutKind.Load())
+}
+
+func (c * Connection) onTimeout(kind TimeoutKind) (bool) {
+    c.timeoutKind.Store(int32(kind))
+    return c.handler.OnTimeout(c)
+}
+
+// TLSConnectionState returns the state of the TLS connection, ok is false if
+// the connection is not secure.
+func (c * Connection) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+    tc, ok := c.conn.(*tls.Conn)
+    if !ok {
+        return
+    }
+    return tc.ConnectionState(), true
+}
+
+// PeerCertificates returns the certificate chain presented by the peer, if
+// any.
+func (c * Connection) PeerCertificates() ([]*x509.Certificate) {
+    state, _ := c.TLSConnectionState()
+    return state.PeerCertificates
+}
+
 func (c * Connection) IsSecure() (bool) {
     if _, ok := c.conn.(*tls.Conn); ok {
         return true
@@ -107,51 +328,209 @@ func (c * Connection) RemoteAddrString() (s string) {
     if c.IsSecure() {
         s += "ssl:"
     } else {
-        s += "tcp:"
+        s += c.conn.RemoteAddr().Network() + ":"
     }
-    s += c.conn.RemoteAddr().String()
+    s += c.RemoteAddr().String()
     return
 }
 
 
 func (c * Connection) Do() {
-    c.server.waitGroup.Add(1)
-    defer c.server.waitGroup.Done()
+    defer c.server.untrack(c)
+    c.serve()
+}
+
+// serve runs the connection until it is closed.
+func (c * Connection) serve() {
+    if c.open() {
+        c.closeWith(c.handleRead())
+    }
+}
+
+// open takes the connection from its acceptance to OnAccept. It returns
+// false if the connection was closed on the way. Connections still waiting
+// for a worker when the server stops are closed with CloseShutdown.
+func (c * Connection) open() (bool) {
+    select {
+    case <-c.closeChan:
+        return false
+    default:
+    }
+    if c.stopping() {
+        c.closeWith(CloseShutdown, ErrShutdown)
+        return false
+    }
+
+    if err := c.readProxyHeader(); err != nil {
+        reason := CloseProtocolError
+        if err == ErrRejected {
+            reason = CloseRejected
+        }
+        c.closeWith(reason, err)
+        return false
+    }
+    if l := c.listener; l != nil && l.mux != nil {
+        if reason, err := l.mux.route(c); err != nil {
+            c.closeWith(reason, err)
+            return false
+        }
+    } else if l != nil && l.lateTLS != nil {
+        c.startTLS(l.lateTLS)
+    }
+    if err := c.handshake(); err != nil {
+        c.closeWith(CloseProtocolError, err)
+        return false
+    }
+    if c.opts.sendQueueDepth > 0 {
+        c.EnableSendQueue(c.opts.sendQueueDepth, c.opts.sendPolicy)
+    }
+    if !c.handler.OnAccept(c) {
+        if c.metrics != nil {
+            c.metrics.rejected.Add(1)
+        }
+        c.closeWith(CloseRejected, ErrRejected)
+        return false
+    }
+    c.accepted.Store(true)
+    if c.stopping() {
+        // Shutdown started during OnAccept and may have missed c.
+        c.notifyShutdown()
+    }
+    if hb, ok := c.protocol.(HeartbeatProtocol); ok && c.opts.heartbeatInterval > 0 {
+        go c.heartbeat(hb)
+    }
+    return true
+}
 
-    if !c.server.handler.OnAccept(c) {
-        c.Close()
+// stopping reports whether the server of c is shutting down. Client
+// connections have no server.
+func (c * Connection) stopping() (bool) {
+    return c.server != nil && c.server.stop.Load()
+}
+
+// notifyShutdown calls the OnShutdown hook of the handler, at most once.
+func (c * Connection) notifyShutdown() {
+    if !c.notified.CompareAndSwap(false, true) {
         return
     }
-    c.handleRead()
+    if h, ok := c.handler.(ShutdownHandler); ok {
+        h.OnShutdown(c)
+    }
 }
 
-func (c * Connection) handleRead() {
-    defer c.Close()
+func (c * Connection) handshake() (err error) {
+    tc, ok := c.conn.(*tls.Conn)
+    if !ok {
+        return
+    }
+    if c.opts.handshakeTimeout > 0 {
+        tc.SetDeadline(time.Now().Add(c.opts.handshakeTimeout))
+        defer tc.SetDeadline(time.Time{})
+    }
+    return tc.Handshake()
+}
 
+// handleRead reads and dispatches packets until the connection ends and
+// returns why it did.
+func (c * Connection) handleRead() (CloseReason, error) {
     for {
         select {
         case <-c.closeChan:
-            return
+            return CloseExplicit, nil
         default:
         }
 
+        if c.opts.idleTimeout > 0 {
+            c.conn.SetReadDeadline(time.Now().Add(c.opts.idleTimeout))
+        } else if c.opts.readTimeout > 0 {
+            c.conn.SetReadDeadline(time.Now().Add(c.opts.readTimeout))
+        }
         _, err := c.reader.Peek(1)
         if err != nil {
-            if err, ok := err.(net.Error); ok && err.Timeout() {
-                if c.server.handler.OnTimeout(c) {
+            if isTimeout(err) {
+                if c.onTimeout(TimeoutIdle) {
                     continue
                 }
+                return CloseTimeout, err
             }
-            return
+            return readCloseReason(err), err
         }
-        p, err := c.server.protocol.ReadPacket(c)
-        if err != nil {
-            return
+        if c.opts.idleTimeout > 0 {
+            var deadline time.Time
+            if c.opts.readTimeout > 0 {
+                deadline = time.Now().Add(c.opts.readTimeout)
+            }
+            c.conn.SetReadDeadline(deadline)
         }
-        if !c.server.handler.OnMessage(c, p) {
-            return
+        if reason, err := c.readPacket(); reason != CloseNone {
+            return reason, err
+        }
+    }
+}
+
+// readPacket reads and dispatches a packet. It returns a close reason if
+// the connection must be closed.
+func (c * Connection) readPacket() (CloseReason, error) {
+    span := c.startSpan("server.read_packet")
+    p, err := c.protocol.ReadPacket(c)
+    if err == nil && c.tracing() {
+        span.SetAttributes(trace.Attr("server.packet.type", packetTypeName(p)))
+    }
+    span.End(err)
+    if err != nil {
+        if isTimeout(err) {
+            c.onTimeout(TimeoutRead)
+            return CloseTimeout, err
+        }
+        if reason := readCloseReason(err); reason != CloseReadError {
+            return reason, err
+        }
+        var nerr net.Error
+        if errors.As(err, &nerr) {
+            return CloseReadError, err
+        }
+        return CloseProtocolError, err
+    }
+    c.countRead(0, 1)
+    reason, err := c.handlePacket(p)
+    releasePacket(p)
+    return reason, err
+}
+
+// handlePacket dispatches a packet read from the peer. It returns a close
+// reason if the connection must be closed.
+func (c * Connection) handlePacket(p Packet) (CloseReason, error) {
+    if ok, reason := c.limitMessage(); !ok {
+        if reason != CloseNone {
+            return reason, ErrRateLimited
         }
+        return CloseNone, nil
+    }
+    if hb, ok := c.protocol.(HeartbeatProtocol); ok {
+        if hb.IsPing(p) {
+            c.Send(hb.PongPacket(p))
+            return CloseNone, nil
+        }
+        if hb.IsPong(p) {
+            c.pong()
+            return CloseNone, nil
+        }
+    }
+    span := c.startSpan("server.on_message")
+    if c.tracing() {
+        span.SetAttributes(trace.Attr("server.packet.type", packetTypeName(p)))
+    }
+    start := time.Now()
+    ok := c.handler.OnMessage(c, p)
+    if c.metrics != nil {
+        c.metrics.latency.observe(time.Since(start))
+    }
+    if !ok {
+        span.End(ErrRejected)
+        return CloseRejected, ErrRejected
     }
+    span.End(nil)
+    return CloseNone, nil
 }
 
 
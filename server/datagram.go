@@ -0,0 +1,459 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "sync/atomic"
+    "github.com/kdruelle/gutils/trace"
+)
+
+const(
+    // MaxDatagramSize is the largest datagram a datagram server receives.
+    MaxDatagramSize = 65535
+    // DefaultSessionTimeout is the idle timeout of datagram sessions when
+    // WithIdleTimeout was not given.
+    DefaultSessionTimeout = time.Minute
+    // DefaultMaxSessions caps the sessions of a datagram server when
+    // Limits.MaxConnections is zero, as any datagram with a new, possibly
+    // spoofed, source address opens one.
+    DefaultMaxSessions = 4096
+    // sessionQueueDepth is the number of datagrams buffered for a session
+    // before new ones are dropped.
+    sessionQueueDepth = 64
+    // sessionBufferSize is the size of the read and write buffers of a
+    // session. DatagramProtocol reads whole datagrams without the buffer,
+    // and a write larger than the buffer bypasses it, so it still makes a
+    // single datagram.
+    sessionBufferSize = 512
+)
+
+// ServePacket serves datagrams received on pc until the server is stopped,
+// then closes pc. Each remote address becomes a session with its own
+// Connection, created on its first datagram, going through the access list
+// and the limits like an accepted stream connection. The protocol reads the
+// session as the stream of its datagrams, and what is written to the
+// session is sent back to the remote address, one datagram per Write or
+// Send. Sessions expire after the idle timeout, and are closed with
+// CloseShutdown when the server stops. Unless Limits.MaxConnections says
+// otherwise, at most DefaultMaxSessions sessions are held at once.
+//
+// A session only holds a worker of the pool while it has datagrams to
+// handle, so that any number of sessions can share a few workers. A packet
+// spanning several datagrams holds the worker until it is complete, within
+// the read timeout, or the idle timeout if there is none.
+func (s * Server) ServePacket(pc net.PacketConn) (error) {
+    if s.idleTimeout == 0 {
+        s.idleTimeout = DefaultSessionTimeout
+    }
+    if !s.setPacketConn(pc) {
+        return nil
+    }
+    buf := make([]byte, MaxDatagramSize)
+    for {
+        n, addr, err := pc.ReadFrom(buf)
+        if err != nil {
+            if s.stop.Load() {
+                s.closeSessions()
+                return nil
+            }
+            if errors.Is(err, net.ErrClosed) {
+                s.closeSessions()
+                return err
+            }
+            continue
+        }
+        if !replyable(addr) {
+            continue
+        }
+        c := s.session(pc, addr)
+        if c != nil {
+            c.conn.(*datagramConn).deliver(append([]byte(nil), buf[:n]...))
+            c.wake()
+        }
+    }
+}
+
+func (s * Server) setPacketConn(pc net.PacketConn) (bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.stop.Load() {
+        pc.Close()
+        return false
+    }
+    s.packetConn = pc
+    return true
+}
+
+func (s * Server) listenPacket() (net.PacketConn, error) {
+    if s.unixSocket {
+        return listenUnixgram(s.localAddr, s.socketPerm)
+    }
+    return net.ListenPacket("udp", s.localAddr)
+}
+
+// session returns the session of addr, creating it if the limits allow it.
+func (s * Server) session(pc net.PacketConn, addr net.Addr) (*Connection) {
+    key := addr.Network() + ":" + addr.String()
+    s.mutex.Lock()
+    c := s.sessions[key]
+    s.mutex.Unlock()
+    if c != nil {
+        return c
+    }
+    ctx, span := s.startAccept(addr, nil)
+    if !s.allowed(addr) || !s.admit(addr, true) {
+        s.metrics.rejected.Add(1)
+        span.End(ErrRejected)
+        return nil
+    }
+
+    dc := &datagramConn{
+        pc:     pc,
+        raddr:  addr,
+        queue:  make(chan []byte, sessionQueueDepth),
+        closed: make(chan struct{}),
+        wake:   make(chan struct{}),
+    }
+    c = newServerConnection(ctx, s, dc)
+    c.datagram = true
+    c.resetIO(sessionBufferSize)
+    if err := s.track(c); err != nil {
+        if err == ErrRejected {
+            s.metrics.rejected.Add(1)
+        }
+        span.End(err)
+        return nil
+    }
+    dc.onClose = c.wake
+    dc.timer = time.AfterFunc(c.opts.idleTimeout, func() {
+        dc.expired.Store(true)
+        c.wake()
+    })
+    s.mutex.Lock()
+    s.sessions[key] = c
+    s.mutex.Unlock()
+    span.SetAttributes(trace.Attr("server.connection.id", c.id))
+    span.End(nil)
+    return c
+}
+
+// wake schedules a job serving the session in the worker pool. If a job is
+// already running, it is told to look for work again before returning.
+func (c * Connection) wake() {
+    dc := c.conn.(*datagramConn)
+    dc.sched.Lock()
+    if dc.finished {
+        dc.sched.Unlock()
+        return
+    }
+    if dc.running {
+        dc.pending = true
+        dc.sched.Unlock()
+        return
+    }
+    dc.running = true
+    dc.sched.Unlock()
+    // The receive loop must not wait for room in the queue of the pool.
+    go c.server.pool.Handle(sessionJob{c})
+}
+
+// sessionJob is the job serving a datagram session until it has no more
+// datagrams to handle.
+type sessionJob struct {
+    c * Connection
+}
+
+func (j sessionJob) Do() {
+    j.c.serveSession()
+}
+
+func (j sessionJob) Context() (context.Context) {
+    return j.c.ctx
+}
+
+func (j sessionJob) DoContext(ctx context.Context) {
+    j.c.traceCtx = ctx
+    j.c.serveSession()
+}
+
+// serveSession opens the session on its first run, then handles the
+// datagrams received so far. The session is untracked by the run that finds
+// it closed.
+func (c * Connection) serveSession() {
+    dc := c.conn.(*datagramConn)
+    if !dc.opened {
+        dc.opened = true
+        c.open()
+    }
+    for {
+        if !c.IsClosed() {
+            c.handleDatagrams(dc)
+        }
+        dc.sched.Lock()
+        if c.IsClosed() {
+            dc.finished = true
+            dc.sched.Unlock()
+            dc.timer.Stop()
+            c.server.untrack(c)
+            return
+        }
+        if dc.pending {
+            dc.pending = false
+            dc.sched.Unlock()
+            continue
+        }
+        dc.running = false
+        dc.sched.Unlock()
+        return
+    }
+}
+
+// handleDatagrams reads and dispatches the packets of the datagrams
+// received, then expires the session if its idle timer fired.
+func (c * Connection) handleDatagrams(dc *datagramConn) {
+    timeout := c.opts.readTimeout
+    if timeout <= 0 {
+        timeout = c.opts.idleTimeout
+    }
+    for !c.IsClosed() && (c.reader.Buffered() > 0 || dc.buffered()) {
+        c.conn.SetReadDeadline(time.Now().Add(timeout))
+        if reason, err := c.readPacket(); reason != CloseNone {
+            c.closeWith(reason, err)
+            return
+        }
+    }
+    if dc.expired.Swap(false) {
+        c.expire(dc)
+    }
+}
+
+// expire closes the session if it has been idle for the idle timeout and
+// OnTimeout does not keep it, and rearms its idle timer otherwise.
+func (c * Connection) expire(dc *datagramConn) {
+    idle := c.opts.idleTimeout
+    if since := time.Since(time.Unix(0, dc.last.Load())); since < idle {
+        dc.timer.Reset(idle - since)
+        return
+    }
+    if c.onTimeout(TimeoutIdle) {
+        dc.timer.Reset(idle)
+        return
+    }
+    c.closeWith(CloseTimeout, os.ErrDeadlineExceeded)
+}
+
+// replyable reports whether datagrams can be sent back to addr, which is not
+// the case of unbound unix sockets.
+func replyable(addr net.Addr) (bool) {
+    if ua, ok := addr.(*net.UnixAddr); ok {
+        return ua != nil && ua.Name != ""
+    }
+    return addr != nil
+}
+
+func (s * Server) closeSessions() {
+    s.mutex.Lock()
+    sessions := make([]*Connection, 0, len(s.sessions))
+    for _, c := range s.sessions {
+        sessions = append(sessions, c)
+    }
+    s.mutex.Unlock()
+    for _, c := range sessions {
+        c.closeWith(CloseShutdown, ErrShutdown)
+    }
+}
+
+// datagramConn is the net.Conn of a datagram session: reads return the
+// datagrams received from the remote address, in order, and writes are sent
+// to it. It also holds the state of the jobs serving the session.
+type datagramConn struct {
+    pc          net.PacketConn
+    raddr       net.Addr
+    queue       chan []byte
+    cur         []byte
+    closeOnce   sync.Once
+    closed      chan struct{}
+    onClose     func()
+    last        atomic.Int64
+
+    mutex       sync.Mutex
+    deadline    time.Time
+    wake        chan struct{}
+
+    sched       sync.Mutex
+    opened      bool
+    running     bool
+    pending     bool
+    finished    bool
+    expired     atomic.Bool
+    timer     * time.Timer
+}
+
+// deliver queues a received datagram, dropping it if the session is not
+// keeping up.
+func (c * datagramConn) deliver(b []byte) {
+    c.last.Store(time.Now().UnixNano())
+    select {
+    case c.queue <- b:
+    case <-c.closed:
+    default:
+    }
+}
+
+// buffered reports whether received datagrams are waiting to be read.
+func (c * datagramConn) buffered() (bool) {
+    return len(c.cur) > 0 || len(c.queue) > 0
+}
+
+// Read copies as much as possible of the current datagram into b. It never
+// returns bytes of two datagrams at once.
+func (c * datagramConn) Read(b []byte) (int, error) {
+    if err := c.wait(); err != nil {
+        return 0, err
+    }
+    n := copy(b, c.cur)
+    c.cur = c.cur[n:]
+    return n, nil
+}
+
+// next returns what is left of the current datagram, without copying it.
+func (c * datagramConn) next() ([]byte, error) {
+    if err := c.wait(); err != nil {
+        return nil, err
+    }
+    b := c.cur
+    c.cur = nil
+    return b, nil
+}
+
+// wait waits for a datagram to read, until the read deadline.
+func (c * datagramConn) wait() (error) {
+    for len(c.cur) == 0 {
+        c.mutex.Lock()
+        deadline, wake := c.deadline, c.wake
+        c.mutex.Unlock()
+
+        var t *time.Timer
+        var timeout <-chan time.Time
+        if !deadline.IsZero() {
+            d := time.Until(deadline)
+            if d <= 0 {
+                return os.ErrDeadlineExceeded
+            }
+            t = time.NewTimer(d)
+            timeout = t.C
+        }
+        var err error
+        select {
+        case c.cur = <-c.queue:
+        case <-c.closed:
+            err = net.ErrClosed
+        case <-timeout:
+            err = os.ErrDeadlineExceeded
+        case <-wake:
+        }
+        if t != nil {
+            t.Stop()
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c * datagramConn) Write(b []byte) (int, error) {
+    select {
+    case <-c.closed:
+        return 0, net.ErrClosed
+    default:
+    }
+    return c.pc.WriteTo(b, c.raddr)
+}
+
+func (c * datagramConn) Close() (error) {
+    c.closeOnce.Do(func() {
+        close(c.closed)
+        if c.onClose != nil {
+            c.onClose()
+        }
+    })
+    return nil
+}
+
+func (c * datagramConn) LocalAddr() (net.Addr) {
+    return c.pc.LocalAddr()
+}
+
+func (c * datagramConn) RemoteAddr() (net.Addr) {
+    return c.raddr
+}
+
+func (c * datagramConn) SetDeadline(t time.Time) (error) {
+    return c.SetReadDeadline(t)
+}
+
+func (c * datagramConn) SetReadDeadline(t time.Time) (error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.deadline = t
+    close(c.wake)
+    c.wake = make(chan struct{})
+    return nil
+}
+
+// SetWriteDeadline is a no-op: the packet connection is shared by all the
+// sessions and datagram writes do not wait on the peer.
+func (c * datagramConn) SetWriteDeadline(t time.Time) (error) {
+    return nil
+}
+
+// DatagramProtocol is the protocol of datagram sessions whose packets are
+// whole datagrams. It returns each datagram as a RawPacket, and sends
+// packets unframed.
+type DatagramProtocol struct {}
+
+func NewDatagramProtocol() (*DatagramProtocol) {
+    return &DatagramProtocol{}
+}
+
+func (p * DatagramProtocol) ReadPacket(c *Connection) (Packet, error) {
+    if dc, ok := c.conn.(*datagramConn); ok && c.reader.Buffered() == 0 {
+        b, err := dc.next()
+        if err != nil {
+            return nil, err
+        }
+        c.countRead(len(b), 0)
+        return RawPacket(b), nil
+    }
+    if _, err := c.reader.Peek(1); err != nil {
+        return nil, err
+    }
+    b := make([]byte, c.reader.Buffered())
+    _, err := c.reader.Read(b)
+    return RawPacket(b), err
+}
@@ -0,0 +1,151 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "runtime"
+    "testing"
+)
+
+type SessionHandler struct {
+    EchoHandler
+    events chan closeEvent
+}
+
+func (h * SessionHandler) OnClose(c *Connection) {
+    h.events <- closeEvent{c, c.CloseReason(), c.Err()}
+}
+
+func TestDatagramServer(t *testing.T) {
+    h := &SessionHandler{events: make(chan closeEvent, 2)}
+    s := NewServer("127.0.0.1:0", h, NewDatagramProtocol(),
+        WithDatagram(), WithIdleTimeout(200 * time.Millisecond))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    a, err := net.Dial("udp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer a.Close()
+    b, err := net.Dial("udp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+
+    buf := make([]byte, 64)
+    for _, conn := range []net.Conn{a, b} {
+        for _, msg := range []string{"one", conn.LocalAddr().String()} {
+            conn.Write([]byte(msg))
+            conn.SetReadDeadline(time.Now().Add(time.Second))
+            n, err := conn.Read(buf)
+            if err != nil || string(buf[:n]) != msg {
+                t.Fatal(string(buf[:n]), err)
+            }
+        }
+    }
+    conns := waitConnections(t, s, 2)
+    if conns[0].RemoteAddrString() != "udp:" + a.LocalAddr().String() {
+        t.Fatal("remote address: ", conns[0].RemoteAddrString())
+    }
+
+    for i := 0; i < 2; i++ {
+        select {
+        case ev := <-h.events:
+            if ev.reason != CloseTimeout {
+                t.Fatal("session closed with ", ev.reason)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("session did not expire")
+        }
+    }
+    waitConnections(t, s, 0)
+}
+
+func TestDatagramSessionsShareWorkers(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewDatagramProtocol(),
+        WithDatagram(), WithWorkers(2))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    peers := make([]net.Conn, 8)
+    for i := range peers {
+        conn, err := net.Dial("udp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        peers[i] = conn
+    }
+    buf := make([]byte, 64)
+    for round := 0; round < 2; round++ {
+        for i, conn := range peers {
+            msg := conn.LocalAddr().String()
+            conn.Write([]byte(msg))
+            conn.SetReadDeadline(time.Now().Add(time.Second))
+            n, err := conn.Read(buf)
+            if err != nil || string(buf[:n]) != msg {
+                t.Fatal("peer ", i, ": ", string(buf[:n]), err)
+            }
+        }
+    }
+    waitConnections(t, s, len(peers))
+}
+
+func TestDatagramSessionsBounded(t *testing.T) {
+    h := &HandlerFuncs{
+        Next:       &Handler{t},
+        Accept:     func(*Connection) bool { return true },
+        Message:    func(*Connection, Packet) bool { return true },
+    }
+    s := NewServer("127.0.0.1:0", h, NewDatagramProtocol(), WithDatagram())
+    startServer(t, s)
+    defer s.Stop()
+    s.mutex.Lock()
+    pc := s.packetConn
+    s.mutex.Unlock()
+
+    var before, after runtime.MemStats
+    runtime.GC()
+    runtime.ReadMemStats(&before)
+    // Feed datagrams from twice as many spoofed sources as sessions allowed.
+    sessions := 0
+    for i := 0; i < 2 * DefaultMaxSessions; i++ {
+        addr := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i >> 8), byte(i)), Port: 9}
+        if c := s.session(pc, addr); c != nil {
+            sessions++
+            c.conn.(*datagramConn).deliver(make([]byte, 100))
+            c.wake()
+        }
+    }
+    if sessions != DefaultMaxSessions {
+        t.Fatal(sessions, " sessions opened")
+    }
+    waitConnections(t, s, DefaultMaxSessions)
+    runtime.GC()
+    runtime.ReadMemStats(&after)
+    if perSession := (after.HeapAlloc - before.HeapAlloc) / DefaultMaxSessions; perSession > 8 << 10 {
+        t.Fatal(perSession, " bytes per session")
+    }
+}
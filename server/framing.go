@@ -0,0 +1,307 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "bufio"
+    "bytes"
+    "errors"
+    "encoding/binary"
+)
+
+var(
+    ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+)
+
+// DefaultMaxFrameSize is the maximum frame size of the framing protocols
+// created with a maxFrameSize of 0.
+const DefaultMaxFrameSize = 4 << 20
+
+func frameSizeLimit(maxFrameSize int) (int) {
+    if maxFrameSize <= 0 {
+        return DefaultMaxFrameSize
+    }
+    return maxFrameSize
+}
+
+// RawPacket is a Packet carrying an opaque payload, as returned by the
+// framing protocols of this package.
+type RawPacket []byte
+
+func (p RawPacket) Serialize() ([]byte) {
+    return p
+}
+
+// PacketEncoder is implemented by protocols that need to frame the packets
+// sent to the peer. When the protocol of a connection implements it, Send
+// and Broadcast write the encoded packet instead of its bare serialization.
+type PacketEncoder interface {
+    EncodePacket(Packet) ([]byte, error)
+}
+
+func encodePacket(protocol Protocol, p Packet) ([]byte, error) {
+    if enc, ok := protocol.(PacketEncoder); ok {
+        return enc.EncodePacket(p)
+    }
+    if pp, ok := p.(*PooledPacket); ok {
+        // The buffer may be released before a send queue writes it.
+        return bytes.Clone(pp.buf), nil
+    }
+    return p.Serialize(), nil
+}
+
+// LengthPrefixProtocol frames packets with a fixed-width unsigned length
+// prefix of 1, 2, 4 or 8 bytes.
+type LengthPrefixProtocol struct {
+    size            int
+    order           binary.ByteOrder
+    maxFrameSize    int
+    pool          * BufferPool
+}
+
+// NewLengthPrefixProtocol returns a protocol using a size bytes length
+// prefix encoded with order. A maxFrameSize of 0 means DefaultMaxFrameSize.
+// It panics if size is not 1, 2, 4 or 8.
+func NewLengthPrefixProtocol(size int, order binary.ByteOrder, maxFrameSize int) (*LengthPrefixProtocol) {
+    switch size {
+    case 1, 2, 4, 8:
+    default:
+        panic("server: invalid length prefix size")
+    }
+    return &LengthPrefixProtocol{
+        size:           size,
+        order:          order,
+        maxFrameSize:   frameSizeLimit(maxFrameSize),
+    }
+}
+
+// UseBufferPool makes the protocol read its packets into buffers of pool,
+// as *PooledPacket, and returns the protocol.
+func (p * LengthPrefixProtocol) UseBufferPool(pool *BufferPool) (*LengthPrefixProtocol) {
+    p.pool = pool
+    return p
+}
+
+func (p * LengthPrefixProtocol) ReadPacket(c *Connection) (Packet, error) {
+    header, err := c.reader.Peek(p.size)
+    if err != nil {
+        if len(header) > 0 {
+            err = unexpectedEOF(err)
+        }
+        return nil, err
+    }
+    n := p.decodeLength(header)
+    c.reader.Discard(p.size)
+    if n > uint64(p.maxFrameSize) {
+        return nil, ErrFrameTooLarge
+    }
+    if p.pool != nil {
+        return ReadPooled(c, p.pool, int(n))
+    }
+    b := make([]byte, n)
+    if _, err := io.ReadFull(c.reader, b); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    return RawPacket(b), nil
+}
+
+func (p * LengthPrefixProtocol) EncodePacket(packet Packet) ([]byte, error) {
+    payload := packet.Serialize()
+    n := uint64(len(payload))
+    if n > uint64(p.maxFrameSize) || (p.size < 8 && n >> (8 * p.size) != 0) {
+        return nil, ErrFrameTooLarge
+    }
+    b := make([]byte, p.size, p.size + len(payload))
+    switch p.size {
+    case 1:
+        b[0] = byte(n)
+    case 2:
+        p.order.PutUint16(b, uint16(n))
+    case 4:
+        p.order.PutUint32(b, uint32(n))
+    case 8:
+        p.order.PutUint64(b, n)
+    }
+    return append(b, payload...), nil
+}
+
+func (p * LengthPrefixProtocol) decodeLength(b []byte) (uint64) {
+    switch p.size {
+    case 1:
+        return uint64(b[0])
+    case 2:
+        return uint64(p.order.Uint16(b))
+    case 4:
+        return uint64(p.order.Uint32(b))
+    }
+    return p.order.Uint64(b)
+}
+
+// VarintProtocol frames packets with an unsigned varint length prefix, as
+// encoded by binary.AppendUvarint.
+type VarintProtocol struct {
+    maxFrameSize    int
+    pool          * BufferPool
+}
+
+// NewVarintProtocol returns a varint length-prefixed protocol. A
+// maxFrameSize of 0 means DefaultMaxFrameSize.
+func NewVarintProtocol(maxFrameSize int) (*VarintProtocol) {
+    return &VarintProtocol{
+        maxFrameSize:   frameSizeLimit(maxFrameSize),
+    }
+}
+
+// UseBufferPool makes the protocol read its packets into buffers of pool,
+// as *PooledPacket, and returns the protocol.
+func (p * VarintProtocol) UseBufferPool(pool *BufferPool) (*VarintProtocol) {
+    p.pool = pool
+    return p
+}
+
+func (p * VarintProtocol) ReadPacket(c *Connection) (Packet, error) {
+    n, err := binary.ReadUvarint(c.reader)
+    if err != nil {
+        return nil, err
+    }
+    if n > uint64(p.maxFrameSize) {
+        return nil, ErrFrameTooLarge
+    }
+    if p.pool != nil {
+        return ReadPooled(c, p.pool, int(n))
+    }
+    b := make([]byte, n)
+    if _, err := io.ReadFull(c.reader, b); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    return RawPacket(b), nil
+}
+
+func (p * VarintProtocol) EncodePacket(packet Packet) ([]byte, error) {
+    payload := packet.Serialize()
+    if len(payload) > p.maxFrameSize {
+        return nil, ErrFrameTooLarge
+    }
+    b := make([]byte, 0, binary.MaxVarintLen64 + len(payload))
+    b = binary.AppendUvarint(b, uint64(len(payload)))
+    return append(b, payload...), nil
+}
+
+// DelimiterProtocol frames packets with a terminating byte sequence. The
+// delimiter is not part of the packets it returns.
+type DelimiterProtocol struct {
+    delim           []byte
+    maxFrameSize    int
+    trimCR          bool
+    pool          * BufferPool
+}
+
+// NewDelimiterProtocol returns a protocol splitting packets on delim. A
+// maxFrameSize of 0 means DefaultMaxFrameSize. It panics if delim is empty.
+func NewDelimiterProtocol(delim []byte, maxFrameSize int) (*DelimiterProtocol) {
+    if len(delim) == 0 {
+        panic("server: empty delimiter")
+    }
+    return &DelimiterProtocol{
+        delim:          bytes.Clone(delim),
+        maxFrameSize:   frameSizeLimit(maxFrameSize),
+    }
+}
+
+// NewLineProtocol returns a protocol splitting packets on '\n'. A trailing
+// '\r' is removed from the packets read.
+func NewLineProtocol(maxFrameSize int) (*DelimiterProtocol) {
+    p := NewDelimiterProtocol([]byte{'\n'}, maxFrameSize)
+    p.trimCR = true
+    return p
+}
+
+// NewNulProtocol returns a protocol splitting packets on NUL bytes.
+func NewNulProtocol(maxFrameSize int) (*DelimiterProtocol) {
+    return NewDelimiterProtocol([]byte{0}, maxFrameSize)
+}
+
+// UseBufferPool makes the protocol read its packets into buffers of pool,
+// as *PooledPacket, and returns the protocol.
+func (p * DelimiterProtocol) UseBufferPool(pool *BufferPool) (*DelimiterProtocol) {
+    p.pool = pool
+    return p
+}
+
+func (p * DelimiterProtocol) ReadPacket(c *Connection) (Packet, error) {
+    if p.pool != nil {
+        pp, err := ReadPooledDelimited(c, p.pool, p.delim, p.maxFrameSize)
+        if err != nil {
+            return nil, err
+        }
+        if p.trimCR {
+            pp.buf = bytes.TrimSuffix(pp.buf, []byte{'\r'})
+        }
+        return pp, nil
+    }
+    last := p.delim[len(p.delim) - 1]
+    var b []byte
+    for {
+        chunk, err := c.reader.ReadSlice(last)
+        b = append(b, chunk...)
+        if len(b) > p.maxFrameSize + len(p.delim) {
+            return nil, ErrFrameTooLarge
+        }
+        if err == bufio.ErrBufferFull {
+            continue
+        }
+        if err != nil {
+            if len(b) > 0 {
+                return nil, unexpectedEOF(err)
+            }
+            return nil, err
+        }
+        if bytes.HasSuffix(b, p.delim) {
+            break
+        }
+    }
+    b = b[:len(b) - len(p.delim)]
+    if len(b) > p.maxFrameSize {
+        return nil, ErrFrameTooLarge
+    }
+    if p.trimCR {
+        b = bytes.TrimSuffix(b, []byte{'\r'})
+    }
+    return RawPacket(b), nil
+}
+
+func (p * DelimiterProtocol) EncodePacket(packet Packet) ([]byte, error) {
+    payload := packet.Serialize()
+    if len(payload) > p.maxFrameSize {
+        return nil, ErrFrameTooLarge
+    }
+    b := make([]byte, 0, len(payload) + len(p.delim))
+    b = append(b, payload...)
+    return append(b, p.delim...), nil
+}
+
+func unexpectedEOF(err error) (error) {
+    if err == io.EOF {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
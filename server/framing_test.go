@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "bytes"
+    "testing"
+    "encoding/binary"
+)
+
+type framingProtocol interface {
+    Protocol
+    PacketEncoder
+}
+
+func readFrames(t *testing.T, p Protocol, stream []byte, n int) (packets []Packet, err error) {
+    local, remote := net.Pipe()
+    defer local.Close()
+    go func() {
+        remote.Write(stream)
+        remote.Close()
+    }()
+    c := NewConnection(nil, local)
+    for i := 0; i < n; i++ {
+        var packet Packet
+        if packet, err = p.ReadPacket(c); err != nil {
+            return
+        }
+        packets = append(packets, packet)
+    }
+    return
+}
+
+func TestFramingRoundTrip(t *testing.T) {
+    protocols := map[string]framingProtocol{
+        "u8":        NewLengthPrefixProtocol(1, binary.BigEndian, 0),
+        "u16be":     NewLengthPrefixProtocol(2, binary.BigEndian, 0),
+        "u32le":     NewLengthPrefixProtocol(4, binary.LittleEndian, 0),
+        "u64be":     NewLengthPrefixProtocol(8, binary.BigEndian, 0),
+        "varint":    NewVarintProtocol(0),
+        "line":      NewLineProtocol(0),
+        "nul":       NewNulProtocol(0),
+        "custom":    NewDelimiterProtocol([]byte("--"), 0),
+    }
+    payloads := []string{"hello", "", "a-b", string(bytes.Repeat([]byte("x"), 5000))}
+
+    for name, p := range protocols {
+        payloads := payloads
+        if name == "u8" {
+            payloads = payloads[:3]
+        }
+        var stream []byte
+        for _, payload := range payloads {
+            b, err := p.EncodePacket(RawPacket(payload))
+            if err != nil {
+                t.Fatal(name, ": ", err)
+            }
+            stream = append(stream, b...)
+        }
+        packets, err := readFrames(t, p, stream, len(payloads))
+        if err != nil {
+            t.Fatal(name, ": ", err)
+        }
+        for i, packet := range packets {
+            if string(packet.Serialize()) != payloads[i] {
+                t.Fatal(name, ": packet ", i, " mismatch")
+            }
+        }
+    }
+}
+
+func TestLineProtocolTrimsCR(t *testing.T) {
+    packets, err := readFrames(t, NewLineProtocol(0), []byte("hello\r\nworld\n"), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(packets[0].Serialize()) != "hello" || string(packets[1].Serialize()) != "world" {
+        t.Fatal(packets)
+    }
+}
+
+func TestFrameTooLarge(t *testing.T) {
+    protocols := map[string][2]framingProtocol{
+        "u16le":     {NewLengthPrefixProtocol(2, binary.LittleEndian, 0), NewLengthPrefixProtocol(2, binary.LittleEndian, 8)},
+        "varint":    {NewVarintProtocol(0), NewVarintProtocol(8)},
+        "line":      {NewLineProtocol(0), NewLineProtocol(8)},
+    }
+    for name, p := range protocols {
+        b, err := p[0].EncodePacket(RawPacket("0123456789"))
+        if err != nil {
+            t.Fatal(name, ": ", err)
+        }
+        if _, err = p[1].EncodePacket(RawPacket("0123456789")); err != ErrFrameTooLarge {
+            t.Fatal(name, ": encode: ", err)
+        }
+        if _, err = readFrames(t, p[1], b, 1); err != ErrFrameTooLarge {
+            t.Fatal(name, ": read: ", err)
+        }
+    }
+
+    if _, err := NewLengthPrefixProtocol(1, binary.BigEndian, 0).EncodePacket(RawPacket(make([]byte, 256))); err != ErrFrameTooLarge {
+        t.Fatal("u8: ", err)
+    }
+}
+
+func TestHugeLengthPrefix(t *testing.T) {
+    huge := bytes.Repeat([]byte{0xff}, 9)
+    protocols := map[string]Protocol{
+        "u32":           NewLengthPrefixProtocol(4, binary.BigEndian, 0),
+        "u64":           NewLengthPrefixProtocol(8, binary.BigEndian, 0),
+        "u64 pooled":    NewLengthPrefixProtocol(8, binary.BigEndian, 0).UseBufferPool(DefaultBufferPool),
+        "u64 limited":   NewLengthPrefixProtocol(8, binary.BigEndian, 1 << 30),
+        "varint":        NewVarintProtocol(0),
+        "varint pooled": NewVarintProtocol(0).UseBufferPool(DefaultBufferPool),
+    }
+    for name, p := range protocols {
+        stream := huge
+        if _, ok := p.(*VarintProtocol); ok {
+            stream = binary.AppendUvarint(nil, 1 << 62)
+        }
+        if _, err := readFrames(t, p, stream, 1); err != ErrFrameTooLarge {
+            t.Fatal(name, ": ", err)
+        }
+    }
+}
@@ -0,0 +1,74 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "time"
+    "errors"
+)
+
+var(
+    ErrHeartbeatTimeout = errors.New("peer stopped answering heartbeats")
+)
+
+// HeartbeatProtocol is implemented by protocols that define ping and pong
+// packets. Pings received on such a protocol are answered automatically and
+// neither pings nor pongs are delivered to the handler.
+type HeartbeatProtocol interface {
+    Protocol
+    PingPacket() Packet
+    PongPacket(ping Packet) Packet
+    IsPing(Packet) bool
+    IsPong(Packet) bool
+}
+
+// RTT returns the round-trip time measured by the last answered heartbeat,
+// or 0 if none was measured yet.
+func (c * Connection) RTT() (time.Duration) {
+    return time.Duration(c.rtt.Load())
+}
+
+func (c * Connection) heartbeat(hb HeartbeatProtocol) {
+    misses := max(c.opts.heartbeatMisses, 1)
+    ticker := time.NewTicker(c.opts.heartbeatInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-c.closeChan:
+            return
+        case <-ticker.C:
+        }
+        if int(c.missedPings.Load()) >= misses {
+            c.closeWith(CloseHeartbeat, ErrHeartbeatTimeout)
+            return
+        }
+        c.missedPings.Add(1)
+        c.pingSent.Store(time.Now().UnixNano())
+        c.Send(hb.PingPacket())
+    }
+}
+
+func (c * Connection) pong() {
+    if sent := c.pingSent.Load(); sent != 0 {
+        c.rtt.Store(time.Now().UnixNano() - sent)
+    }
+    c.missedPings.Store(0)
+}
@@ -0,0 +1,105 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "context"
+    "testing"
+)
+
+type PingProtocol struct {
+    *DelimiterProtocol
+}
+
+func (p * PingProtocol) PingPacket() Packet {
+    return RawPacket("PING")
+}
+
+func (p * PingProtocol) PongPacket(ping Packet) Packet {
+    return RawPacket("PONG")
+}
+
+func (p * PingProtocol) IsPing(packet Packet) bool {
+    return string(packet.Serialize()) == "PING"
+}
+
+func (p * PingProtocol) IsPong(packet Packet) bool {
+    return string(packet.Serialize()) == "PONG"
+}
+
+type CloseErrHandler struct {
+    EchoHandler
+    errs chan error
+}
+
+func (h * CloseErrHandler) OnClose(c *Connection) {
+    h.errs <- c.Err()
+}
+
+func TestHeartbeat(t *testing.T) {
+    for _, misses := range []int{2, 0} {
+        testHeartbeat(t, misses)
+    }
+}
+
+func testHeartbeat(t *testing.T, misses int) {
+    p := &PingProtocol{NewLineProtocol(0)}
+    h := &CloseErrHandler{errs: make(chan error, 2)}
+    s := NewServer("127.0.0.1:0", h, p, WithHeartbeat(time.Millisecond * 20, misses))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    cl := NewClient(addr.String(), &ClientHandler{messages: make(chan string, 1)}, p)
+    if err := cl.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer cl.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if _, err := cl.WaitConnected(ctx); err != nil {
+        t.Fatal(err)
+    }
+
+    time.Sleep(time.Millisecond * 150)
+    conns := s.Connections()
+    if len(conns) != 1 {
+        t.Fatal("answering peer was disconnected")
+    }
+    if conns[0].RTT() <= 0 {
+        t.Fatal("round-trip time was not measured")
+    }
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    select {
+    case err = <-h.errs:
+        if err != ErrHeartbeatTimeout {
+            t.Fatal(err)
+        }
+    case <-ctx.Done():
+        t.Fatal("silent peer was not disconnected")
+    }
+}
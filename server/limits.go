@@ -0,0 +1,367 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "sync"
+    "time"
+    "errors"
+    "net/netip"
+    "sync/atomic"
+)
+
+var(
+    ErrRateLimited = errors.New("message rate limit exceeded")
+)
+
+// Limits configures the admission control of a Server. A zero field
+// disables the corresponding limit. Per-IP limits only apply to IP
+// connections. On listeners using the PROXY protocol, they apply to the
+// client address of the header rather than to the load balancer.
+type Limits struct {
+    // MaxConnections limits the connections held at once. Datagram
+    // servers default to DefaultMaxSessions.
+    MaxConnections          int
+    // MaxConnectionsPerIP limits the connections held at once per remote IP.
+    MaxConnectionsPerIP     int
+    // AcceptRate limits the connections accepted per second, with bursts
+    // of up to AcceptBurst connections.
+    AcceptRate              float64
+    AcceptBurst             int
+    // AcceptRatePerIP and AcceptBurstPerIP do the same per remote IP.
+    AcceptRatePerIP         float64
+    AcceptBurstPerIP        int
+    // MessageRate limits the packets read per second on each connection,
+    // with bursts of up to MessageBurst packets.
+    MessageRate             float64
+    MessageBurst            int
+}
+
+// LimitKind identifies the limit that fired.
+type LimitKind int
+
+const(
+    LimitConnections LimitKind = iota
+    LimitConnectionsPerIP
+    LimitAcceptRate
+    LimitAcceptRatePerIP
+    LimitMessageRate
+    limitKinds
+)
+
+func (k LimitKind) String() (string) {
+    switch k {
+    case LimitConnections:
+        return "connections"
+    case LimitConnectionsPerIP:
+        return "connections per ip"
+    case LimitAcceptRate:
+        return "accept rate"
+    case LimitAcceptRatePerIP:
+        return "accept rate per ip"
+    case LimitMessageRate:
+        return "message rate"
+    }
+    return "unknown"
+}
+
+// LimitAction is what a LimitPolicy decides to do when a limit fires.
+type LimitAction int
+
+const(
+    // LimitReject closes the incoming connection, or drops the packet.
+    LimitReject LimitAction = iota
+    // LimitDelay waits for the message rate to allow the packet. Limits
+    // checked when accepting a connection cannot be delayed, as that would
+    // stall the accept loop for every client, and reject instead.
+    LimitDelay
+    // LimitDisconnect closes the connection that exceeded its message
+    // rate with CloseRateLimited. At accept time it is LimitReject.
+    LimitDisconnect
+)
+
+// LimitPolicy decides what to do when a limit fires. addr is the remote
+// address, c is the connection for LimitMessageRate and nil otherwise.
+type LimitPolicy func(kind LimitKind, addr net.Addr, c *Connection) LimitAction
+
+// DefaultLimitPolicy rejects connections exceeding a limit and delays the
+// packets exceeding the message rate.
+func DefaultLimitPolicy(kind LimitKind, addr net.Addr, c *Connection) (LimitAction) {
+    if kind == LimitMessageRate {
+        return LimitDelay
+    }
+    return LimitReject
+}
+
+// LimitStats counts how many times each limit fired.
+type LimitStats struct {
+    Connections         uint64
+    ConnectionsPerIP    uint64
+    AcceptRate          uint64
+    AcceptRatePerIP     uint64
+    MessageRate         uint64
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second, holding
+// at most burst tokens.
+type tokenBucket struct {
+    mutex       sync.Mutex
+    rate        float64
+    burst       float64
+    tokens      float64
+    last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int) (*tokenBucket) {
+    if burst < 1 {
+        burst = 1
+    }
+    return &tokenBucket{
+        rate:   rate,
+        burst:  float64(burst),
+        tokens: float64(burst),
+        last:   time.Now(),
+    }
+}
+
+func (b * tokenBucket) refill(now time.Time) {
+    if elapsed := now.Sub(b.last); elapsed > 0 {
+        b.tokens = min(b.burst, b.tokens + elapsed.Seconds() * b.rate)
+        b.last = now
+    }
+}
+
+// take consumes a token if one is available.
+func (b * tokenBucket) take(now time.Time) (bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.refill(now)
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// reserve consumes a token, going into debt if needed, and returns how long
+// to wait for it to be actually available.
+func (b * tokenBucket) reserve(now time.Time) (time.Duration) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.refill(now)
+    b.tokens--
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, meaning it holds
+// no state worth keeping.
+func (b * tokenBucket) full(now time.Time) (bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.refill(now)
+    return b.tokens >= b.burst
+}
+
+type ipState struct {
+    conns       int
+    bucket    * tokenBucket
+}
+
+type limiter struct {
+    Limits
+    policy          LimitPolicy
+    accept        * tokenBucket
+
+    mutex           sync.Mutex
+    ips             map[netip.Addr]*ipState
+    hits            [limitKinds]atomic.Uint64
+}
+
+func (l * limiter) init() {
+    if l.policy == nil {
+        l.policy = DefaultLimitPolicy
+    }
+    if l.AcceptRate > 0 {
+        l.accept = newTokenBucket(l.AcceptRate, l.AcceptBurst)
+    }
+    l.ips = make(map[netip.Addr]*ipState)
+}
+
+func (l * limiter) fire(kind LimitKind, addr net.Addr, c *Connection) (LimitAction) {
+    l.hits[kind].Add(1)
+    return l.policy(kind, addr, c)
+}
+
+// allow applies the accept rate of b. The policy is consulted for the sake
+// of its side effects only, as accept-time limits always reject.
+func (l * limiter) allow(b *tokenBucket, kind LimitKind, addr net.Addr) (bool) {
+    if b.take(time.Now()) {
+        return true
+    }
+    l.fire(kind, addr, nil)
+    return false
+}
+
+// admit applies the accept rates to a newly accepted connection from addr,
+// the per-IP one only if perIP is set. The connection count limits are
+// applied by track.
+func (s * Server) admit(addr net.Addr, perIP bool) (bool) {
+    l := &s.limiter
+    if l.accept != nil && !l.allow(l.accept, LimitAcceptRate, addr) {
+        return false
+    }
+    if ip, ok := remoteIP(addr); ok && perIP && l.AcceptRatePerIP > 0 && !l.allow(l.ipBucket(ip), LimitAcceptRatePerIP, addr) {
+        return false
+    }
+    return true
+}
+
+// admitSource applies the per-IP limits to src, the client address of a
+// connection accepted through the PROXY protocol, and counts c against it.
+func (s * Server) admitSource(c *Connection, src net.Addr) (bool) {
+    l := &s.limiter
+    ip, ok := remoteIP(src)
+    if !ok {
+        return true
+    }
+    if l.AcceptRatePerIP > 0 && !l.allow(l.ipBucket(ip), LimitAcceptRatePerIP, src) {
+        return false
+    }
+    if !l.open(ip) {
+        l.fire(LimitConnectionsPerIP, src, nil)
+        return false
+    }
+    c.remoteIP = ip
+    return true
+}
+
+func (l * limiter) ipBucket(ip netip.Addr) (*tokenBucket) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    st := l.state(ip)
+    if st.bucket == nil {
+        st.bucket = newTokenBucket(l.AcceptRatePerIP, l.AcceptBurstPerIP)
+    }
+    return st.bucket
+}
+
+func (l * limiter) state(ip netip.Addr) (*ipState) {
+    st, ok := l.ips[ip]
+    if !ok {
+        if len(l.ips) >= 1024 {
+            l.prune()
+        }
+        st = &ipState{}
+        l.ips[ip] = st
+    }
+    return st
+}
+
+// prune forgets the addresses that have no connection and a full bucket.
+func (l * limiter) prune() {
+    now := time.Now()
+    for ip, st := range l.ips {
+        if st.conns == 0 && (st.bucket == nil || st.bucket.full(now)) {
+            delete(l.ips, ip)
+        }
+    }
+}
+
+// open counts a connection from ip, unless MaxConnectionsPerIP is reached.
+func (l * limiter) open(ip netip.Addr) (bool) {
+    if !ip.IsValid() {
+        return true
+    }
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    st := l.state(ip)
+    if l.MaxConnectionsPerIP > 0 && st.conns >= l.MaxConnectionsPerIP {
+        return false
+    }
+    st.conns++
+    return true
+}
+
+func (l * limiter) closed(ip netip.Addr) {
+    if !ip.IsValid() {
+        return
+    }
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    if st, ok := l.ips[ip]; ok {
+        st.conns--
+    }
+}
+
+// LimitStats returns how many times each limit fired since the server was
+// created.
+func (s * Server) LimitStats() (LimitStats) {
+    h := &s.limiter.hits
+    return LimitStats{
+        Connections:        h[LimitConnections].Load(),
+        ConnectionsPerIP:   h[LimitConnectionsPerIP].Load(),
+        AcceptRate:         h[LimitAcceptRate].Load(),
+        AcceptRatePerIP:    h[LimitAcceptRatePerIP].Load(),
+        MessageRate:        h[LimitMessageRate].Load(),
+    }
+}
+
+// limitMessage applies the message rate to a packet just read. It returns
+// false if the packet must be dropped, and a close reason if the connection
+// must be closed.
+func (c * Connection) limitMessage() (bool, CloseReason) {
+    if c.messages == nil {
+        return true, CloseNone
+    }
+    now := time.Now()
+    if c.messages.take(now) {
+        return true, CloseNone
+    }
+    switch c.server.limiter.fire(LimitMessageRate, c.RemoteAddr(), c) {
+    case LimitDelay:
+        t := time.NewTimer(c.messages.reserve(now))
+        defer t.Stop()
+        select {
+        case <-t.C:
+        case <-c.closeChan:
+        }
+        return true, CloseNone
+    case LimitDisconnect:
+        return false, CloseRateLimited
+    }
+    return false, CloseNone
+}
+
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+    switch a := addr.(type) {
+    case *net.TCPAddr:
+        ip := a.AddrPort().Addr().Unmap()
+        return ip, ip.IsValid()
+    case *net.UDPAddr:
+        ip := a.AddrPort().Addr().Unmap()
+        return ip, ip.IsValid()
+    }
+    return netip.Addr{}, false
+}
@@ -0,0 +1,131 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "testing"
+)
+
+func TestTokenBucket(t *testing.T) {
+    now := time.Now()
+    b := newTokenBucket(10, 2)
+    b.last = now
+    if !b.take(now) || !b.take(now) {
+        t.Fatal("burst was not available")
+    }
+    if b.take(now) {
+        t.Fatal("empty bucket gave a token")
+    }
+    if wait := b.reserve(now); wait != 100 * time.Millisecond {
+        t.Fatal("reserve waits ", wait)
+    }
+    if !b.take(now.Add(200 * time.Millisecond)) {
+        t.Fatal("bucket was not refilled")
+    }
+}
+
+func TestLimitConnectionsPerIP(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64),
+        WithLimits(Limits{MaxConnectionsPerIP: 1}))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    first, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer first.Close()
+    waitConnections(t, s, 1)
+
+    second, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer second.Close()
+    second.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+        t.Fatal("second connection was not rejected: ", err)
+    }
+    if st := s.LimitStats(); st.ConnectionsPerIP != 1 {
+        t.Fatal("limit fired ", st.ConnectionsPerIP, " times")
+    }
+}
+
+func TestLimitMessageRateDisconnect(t *testing.T) {
+    h := &ReasonHandler{events: make(chan closeEvent, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(64),
+        WithLimits(Limits{MessageRate: 1, MessageBurst: 2}),
+        WithLimitPolicy(func(LimitKind, net.Addr, *Connection) LimitAction {
+            return LimitDisconnect
+        }))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.Write([]byte("a\nb\nc\n"))
+    select {
+    case ev := <-h.events:
+        if ev.reason != CloseRateLimited || ev.err != ErrRateLimited {
+            t.Fatal(ev.reason, ", ", ev.err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("connection was not rate limited")
+    }
+    if st := s.LimitStats(); st.MessageRate != 1 {
+        t.Fatal("limit fired ", st.MessageRate, " times")
+    }
+}
+
+func TestLimitAcceptRateNeverDelays(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64),
+        WithLimits(Limits{AcceptRatePerIP: 0.1, AcceptBurstPerIP: 1}),
+        WithLimitPolicy(func(LimitKind, net.Addr, *Connection) LimitAction {
+            return LimitDelay
+        }))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    first, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer first.Close()
+    waitConnections(t, s, 1)
+
+    second, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer second.Close()
+    second.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+        t.Fatal("connection over the accept rate was not rejected: ", err)
+    }
+    if st := s.LimitStats(); st.AcceptRatePerIP != 1 {
+        t.Fatal("limit fired ", st.AcceptRatePerIP, " times")
+    }
+}
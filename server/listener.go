@@ -0,0 +1,241 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "net"
+    "sync"
+    "errors"
+    "crypto/tls"
+    "github.com/kdruelle/gutils/trace"
+)
+
+// Listener is one of the addresses a Server accepts connections on. Each
+// listener may have its own TLS settings and Protocol, while the handler,
+// the limits, the worker pool and the shutdown are those of the server.
+type Listener struct {
+    name        string
+    addr        string
+    protocol    Protocol
+    ssl         bool
+    tlsConfig * tls.Config
+    proxyMode   ProxyProtocolMode
+    proxySet    bool
+    lateTLS   * tls.Config
+    unixSocket  bool
+    socketPerm  os.FileMode
+    mux       * Mux
+    listener    net.Listener
+}
+
+// ListenerOption configures a Listener added by WithListener.
+type ListenerOption func(*Listener)
+
+// ListenerTLS makes the listener use TLS with config. If config is nil, the
+// TLS settings of the server are used, as given by WithTLSConfig,
+// WithCertFiles and WithClientCAs.
+func ListenerTLS(config *tls.Config) (ListenerOption) {
+    return func(l *Listener) {
+        l.ssl = true
+        l.tlsConfig = config
+    }
+}
+
+// ListenerProtocol sets the protocol of the connections accepted on the
+// listener, instead of the protocol of the server.
+func ListenerProtocol(protocol Protocol) (ListenerOption) {
+    return func(l *Listener) {
+        l.protocol = protocol
+    }
+}
+
+// ListenerProxyProtocol overrides the PROXY protocol mode of the server for
+// the listener.
+func ListenerProxyProtocol(mode ProxyProtocolMode) (ListenerOption) {
+    return func(l *Listener) {
+        l.proxyMode = mode
+        l.proxySet = true
+    }
+}
+
+// ListenerUnixSocket makes the listener listen on a unix socket, as
+// WithUnixSocket does for the server's local address.
+func ListenerUnixSocket(perm os.FileMode) (ListenerOption) {
+    return func(l *Listener) {
+        l.unixSocket = true
+        l.socketPerm = perm
+    }
+}
+
+// ListenerMux serves the connections of the listener through mux, as WithMux
+// does for the server's local address.
+func ListenerMux(mux *Mux) (ListenerOption) {
+    return func(l *Listener) {
+        l.mux = mux
+    }
+}
+
+// Name returns the name the listener was given, empty for the local address
+// of the server.
+func (l * Listener) Name() (string) {
+    return l.name
+}
+
+// Addr returns the address the listener is listening on, or nil if it is
+// not listening yet.
+func (l * Listener) Addr() (net.Addr) {
+    if l.listener == nil {
+        return nil
+    }
+    return l.listener.Addr()
+}
+
+// IsSecure reports whether the listener uses TLS.
+func (l * Listener) IsSecure() (bool) {
+    return l.ssl
+}
+
+func (l * Listener) listen() (net.Listener, error) {
+    if l.unixSocket {
+        return listenUnix(l.addr, l.socketPerm)
+    }
+    return net.Listen("tcp", l.addr)
+}
+
+// Listener returns the listener the connection was accepted on, or nil for
+// connections that were not accepted by a Server listener.
+func (c * Connection) Listener() (*Listener) {
+    return c.listener
+}
+
+// defaultListener describes the local address of the server.
+func (s * Server) defaultListener() (*Listener) {
+    return &Listener{
+        addr:       s.localAddr,
+        ssl:        s.ssl,
+        unixSocket: s.unixSocket,
+        socketPerm: s.socketPerm,
+        mux:        s.mux,
+    }
+}
+
+// serveListeners serves each listener on its net.Listener until the server
+// is stopped, and returns the first error that made one of them unusable.
+func (s * Server) serveListeners(listeners []*Listener, nls []net.Listener) (error) {
+    var serverTLS *tls.Config
+    for i, l := range listeners {
+        if !l.proxySet {
+            l.proxyMode = s.proxyMode
+        }
+        if !l.ssl {
+            continue
+        }
+        config := l.tlsConfig
+        if config == nil {
+            if serverTLS == nil {
+                var err error
+                if serverTLS, err = s.buildTLSConfig(); err != nil {
+                    for _, nl := range nls {
+                        nl.Close()
+                    }
+                    return err
+                }
+            }
+            config = serverTLS
+        }
+        // The PROXY header and the bytes sniffed by the Mux come before the
+        // TLS handshake, so the connections start TLS themselves.
+        if l.proxyMode != ProxyProtocolOff || l.mux != nil {
+            l.lateTLS = config
+        } else {
+            nls[i] = tls.NewListener(nls[i], config)
+        }
+    }
+
+    s.mutex.Lock()
+    if s.stop.Load() {
+        s.mutex.Unlock()
+        for _, nl := range nls {
+            nl.Close()
+        }
+        return nil
+    }
+    for i, l := range listeners {
+        l.listener = nls[i]
+    }
+    s.listeners = append(s.listeners, listeners...)
+    s.mutex.Unlock()
+
+    var wg sync.WaitGroup
+    errs := make([]error, len(listeners))
+    for i, l := range listeners {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            errs[i] = s.serve(l)
+        }()
+    }
+    wg.Wait()
+    return errors.Join(errs...)
+}
+
+func (s * Server) serve(l * Listener) (error) {
+    for {
+        conn, err := l.listener.Accept()
+        if err != nil {
+            if s.stop.Load() {
+                return nil
+            }
+            if errors.Is(err, net.ErrClosed) {
+                return err
+            }
+            continue
+        }
+        ctx, span := s.startAccept(conn.RemoteAddr(), l)
+        // Behind a load balancer, the access list and the per-IP limits
+        // wait for the client address of the PROXY header.
+        proxied := l.proxyMode != ProxyProtocolOff
+        if (!proxied && !s.allowed(conn.RemoteAddr())) || !s.admit(conn.RemoteAddr(), !proxied) {
+            s.metrics.rejected.Add(1)
+            conn.Close()
+            span.End(ErrRejected)
+            continue
+        }
+        c := newServerConnection(ctx, s, conn)
+        c.listener = l
+        if l.protocol != nil {
+            c.protocol = l.protocol
+        }
+        if err := s.track(c); err != nil {
+            conn.Close()
+            span.End(err)
+            if err == ErrShutdown {
+                return nil
+            }
+            s.metrics.rejected.Add(1)
+            continue
+        }
+        span.SetAttributes(trace.Attr("server.connection.id", c.id))
+        s.pool.Handle(c)
+        span.End(nil)
+    }
+}
@@ -0,0 +1,93 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "bufio"
+    "testing"
+    "crypto/tls"
+)
+
+type ListenerHandler struct {
+    EchoHandler
+    names chan string
+}
+
+func (h * ListenerHandler) OnAccept(c *Connection) bool {
+    h.names <- c.Listener().Name()
+    return true
+}
+
+func TestMultipleListeners(t *testing.T) {
+    ca := newTestCA(t)
+    _, key, der := ca.issue(t, "server", []string{"localhost"}, false)
+    config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+    h := &ListenerHandler{names: make(chan string, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(64),
+        WithListener("secure", "127.0.0.1:0", ListenerTLS(config)),
+        WithListener("admin", "127.0.0.1:0", ListenerProtocol(NewDelimiterProtocol([]byte(";"), 64))))
+    startServer(t, s)
+    defer s.Stop()
+
+    var listeners []*Listener
+    for i := 0; i < 100 && len(listeners) != 3; i++ {
+        time.Sleep(time.Millisecond * 10)
+        listeners = s.Listeners()
+    }
+    if len(listeners) != 3 {
+        t.Fatal("listening on ", len(listeners), " listeners")
+    }
+
+    tests := []struct{
+        name    string
+        send    string
+        dial    func(addr string) (net.Conn, error)
+    }{
+        {"",        "plain\n",  func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }},
+        {"secure",  "secure\n", func(addr string) (net.Conn, error) {
+            return tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: ca.pool()})
+        }},
+        {"admin",   "admin;",   func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }},
+    }
+    for i, tt := range tests {
+        if listeners[i].Name() != tt.name {
+            t.Fatal("listener ", i, " is ", listeners[i].Name())
+        }
+        conn, err := tt.dial(listeners[i].Addr().String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.Write([]byte(tt.send))
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        reply, err := bufio.NewReader(conn).ReadString(tt.send[len(tt.send) - 1])
+        if err != nil || reply != tt.send {
+            t.Fatal(tt.name, ": ", reply, err)
+        }
+        if name := <-h.names; name != tt.name {
+            t.Fatal("connection reports listener ", name)
+        }
+    }
+    waitConnections(t, s, 3)
+}
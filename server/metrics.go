@@ -0,0 +1,213 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "slices"
+    "sync/atomic"
+)
+
+// defaultBufferSize is the size of the read and write buffers of stream
+// connections.
+const defaultBufferSize = 4096
+
+// latencyBounds are the upper bounds of the buckets of the OnMessage latency
+// histogram.
+var latencyBounds = [...]time.Duration{
+    100 * time.Microsecond,
+    500 * time.Microsecond,
+    time.Millisecond,
+    5 * time.Millisecond,
+    10 * time.Millisecond,
+    50 * time.Millisecond,
+    100 * time.Millisecond,
+    500 * time.Millisecond,
+    time.Second,
+    5 * time.Second,
+}
+
+// IOStats counts the traffic of a connection or of a whole server. Bytes
+// are counted as read and written by the protocol, after TLS decryption.
+// A packet is sent once Send or Broadcast accepted it.
+type IOStats struct {
+    BytesIn     uint64
+    BytesOut    uint64
+    PacketsIn   uint64
+    PacketsOut  uint64
+}
+
+// Histogram is a snapshot of a latency histogram. Counts[i] is the number of
+// observations in (Bounds[i-1], Bounds[i]], the last count being the number
+// of observations above the last bound. Count is the sum of Counts.
+type Histogram struct {
+    Bounds  []time.Duration
+    Counts  []uint64
+    Count   uint64
+    Sum     time.Duration
+}
+
+// Stats is a snapshot of the activity of a Server.
+type Stats struct {
+    // Accepted counts the connections that passed the access list and the
+    // limits, Rejected the ones refused by those or by OnAccept.
+    Accepted        uint64
+    Rejected        uint64
+    // Active is the number of connections currently held.
+    Active          int
+    IOStats
+    // MessageLatency is the time spent in OnMessage.
+    MessageLatency  Histogram
+    // Workers is the size of the worker pool, BusyWorkers the number of
+    // workers serving a connection and QueueDepth the number of connections
+    // waiting for a worker.
+    Workers         int
+    BusyWorkers     int
+    QueueDepth      int
+    Limits          LimitStats
+}
+
+// ConnectionStats is a snapshot of the activity of a Connection.
+type ConnectionStats struct {
+    IOStats
+    // Since is when the connection was created.
+    Since   time.Time
+}
+
+type ioCounters struct {
+    bytesIn     atomic.Uint64
+    bytesOut    atomic.Uint64
+    packetsIn   atomic.Uint64
+    packetsOut  atomic.Uint64
+}
+
+func (c * ioCounters) addRead(bytes, packets int) {
+    c.bytesIn.Add(uint64(bytes))
+    c.packetsIn.Add(uint64(packets))
+}
+
+func (c * ioCounters) addWrite(bytes, packets int) {
+    c.bytesOut.Add(uint64(bytes))
+    c.packetsOut.Add(uint64(packets))
+}
+
+func (c * ioCounters) snapshot() (IOStats) {
+    return IOStats{
+        BytesIn:    c.bytesIn.Load(),
+        BytesOut:   c.bytesOut.Load(),
+        PacketsIn:  c.packetsIn.Load(),
+        PacketsOut: c.packetsOut.Load(),
+    }
+}
+
+type histogram struct {
+    counts  [len(latencyBounds) + 1]atomic.Uint64
+    sum     atomic.Int64
+}
+
+func (h * histogram) observe(d time.Duration) {
+    i := 0
+    for i < len(latencyBounds) && d > latencyBounds[i] {
+        i++
+    }
+    h.counts[i].Add(1)
+    h.sum.Add(int64(d))
+}
+
+// snapshot loads the histogram. The total count is derived from the bucket
+// counts, so that it is consistent with them under concurrent observations.
+func (h * histogram) snapshot() (Histogram) {
+    s := Histogram{
+        Bounds: slices.Clone(latencyBounds[:]),
+        Counts: make([]uint64, len(latencyBounds) + 1),
+        Sum:    time.Duration(h.sum.Load()),
+    }
+    for i := range s.Counts {
+        s.Counts[i] = h.counts[i].Load()
+        s.Count += s.Counts[i]
+    }
+    return s
+}
+
+type serverMetrics struct {
+    accepted    atomic.Uint64
+    rejected    atomic.Uint64
+    io          ioCounters
+    latency     histogram
+}
+
+// Stats returns a snapshot of the activity of the server since it was
+// created.
+func (s * Server) Stats() (Stats) {
+    return Stats{
+        Accepted:       s.metrics.accepted.Load(),
+        Rejected:       s.metrics.rejected.Load(),
+        Active:         s.connectionCount(),
+        IOStats:        s.metrics.io.snapshot(),
+        MessageLatency: s.metrics.latency.snapshot(),
+        Workers:        s.pool.Workers(),
+        BusyWorkers:    s.pool.Busy(),
+        QueueDepth:     s.pool.QueueDepth(),
+        Limits:         s.LimitStats(),
+    }
+}
+
+// Stats returns a snapshot of the activity of the connection.
+func (c * Connection) Stats() (ConnectionStats) {
+    return ConnectionStats{
+        IOStats:    c.io.snapshot(),
+        Since:      c.created,
+    }
+}
+
+func (c * Connection) countRead(bytes, packets int) {
+    c.io.addRead(bytes, packets)
+    if c.metrics != nil {
+        c.metrics.io.addRead(bytes, packets)
+    }
+}
+
+func (c * Connection) countWrite(bytes, packets int) {
+    c.io.addWrite(bytes, packets)
+    if c.metrics != nil {
+        c.metrics.io.addWrite(bytes, packets)
+    }
+}
+
+// connIO is what the buffered reader and writer of a connection use to
+// access its net.Conn, counting the bytes.
+type connIO struct {
+    conn    net.Conn
+    c     * Connection
+}
+
+func (rw connIO) Read(b []byte) (int, error) {
+    n, err := rw.conn.Read(b)
+    rw.c.countRead(n, 0)
+    return n, err
+}
+
+func (rw connIO) Write(b []byte) (int, error) {
+    n, err := rw.conn.Write(b)
+    rw.c.countWrite(n, 0)
+    return n, err
+}
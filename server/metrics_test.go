@@ -0,0 +1,115 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "bufio"
+    "strings"
+    "testing"
+)
+
+func TestStats(t *testing.T) {
+    acl, _ := NewAccessList(nil, []string{"127.0.0.2"})
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64), WithAccessList(acl))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    for _, msg := range []string{"hello\n", "world\n"} {
+        conn.Write([]byte(msg))
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        if _, err := r.ReadString('\n'); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if denied, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}).Dial("tcp", addr.String()); err == nil {
+        denied.Close()
+    }
+
+    conns := waitConnections(t, s, 1)
+    cs := conns[0].Stats()
+    want := IOStats{BytesIn: 12, BytesOut: 12, PacketsIn: 2, PacketsOut: 2}
+    if cs.IOStats != want {
+        t.Fatal("connection stats: ", cs.IOStats)
+    }
+
+    var st Stats
+    for i := 0; i < 100; i++ {
+        if st = s.Stats(); st.Rejected == 1 {
+            break
+        }
+        time.Sleep(time.Millisecond * 10)
+    }
+    if st.Accepted < 1 || st.Rejected != 1 || st.Active != 1 || st.IOStats != want {
+        t.Fatal("server stats: ", st)
+    }
+    if st.MessageLatency.Count != 2 || st.BusyWorkers != 1 || st.QueueDepth != 0 {
+        t.Fatal("server stats: ", st)
+    }
+
+    var b strings.Builder
+    if err := s.WritePrometheus(&b, "test"); err != nil {
+        t.Fatal(err)
+    }
+    for _, line := range []string{
+        "test_connections_rejected_total 1\n",
+        "test_received_packets_total 2\n",
+        "test_message_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+        "test_limit_hits_total{limit=\"connections\"} 0\n",
+    } {
+        if !strings.Contains(b.String(), line) {
+            t.Fatal("missing ", line, " in\n", b.String())
+        }
+    }
+}
+
+func TestHistogramSnapshotConsistent(t *testing.T) {
+    var h histogram
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 10000; i++ {
+            h.observe(time.Duration(i) * time.Microsecond)
+        }
+    }()
+    for running := true; running; {
+        select {
+        case <-done:
+            running = false
+        default:
+        }
+        st := h.snapshot()
+        var total uint64
+        for _, n := range st.Counts {
+            total += n
+        }
+        if st.Count != total {
+            t.Fatal("count ", st.Count, " != sum of buckets ", total)
+        }
+    }
+}
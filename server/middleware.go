@@ -0,0 +1,199 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "time"
+    "context"
+    "reflect"
+    "log/slog"
+)
+
+// Middleware wraps a ConnectionHandler to add behaviour around its callbacks.
+type Middleware func(ConnectionHandler) ConnectionHandler
+
+// Chain wraps h with mws. The first middleware is the outermost one, it
+// sees the callbacks first. If h is a ShutdownHandler, so is the returned
+// handler.
+func Chain(h ConnectionHandler, mws ...Middleware) (ConnectionHandler) {
+    wrapped := h
+    for i := len(mws) - 1; i >= 0; i-- {
+        wrapped = mws[i](wrapped)
+    }
+    if sh, ok := h.(ShutdownHandler); ok {
+        if _, ok := wrapped.(ShutdownHandler); !ok {
+            return &chain{wrapped, sh}
+        }
+    }
+    return wrapped
+}
+
+type chain struct {
+    ConnectionHandler
+    shutdown    ShutdownHandler
+}
+
+func (ch * chain) OnShutdown(c *Connection) {
+    ch.shutdown.OnShutdown(c)
+}
+
+// HandlerFuncs is a ConnectionHandler built from functions, convenient to
+// write middlewares. A nil function delegates the callback to Next.
+type HandlerFuncs struct {
+    Next        ConnectionHandler
+    Accept      func(*Connection) bool
+    Message     func(*Connection, Packet) bool
+    Timeout     func(*Connection) bool
+    Close       func(*Connection)
+}
+
+func (h * HandlerFuncs) OnAccept(c *Connection) (bool) {
+    if h.Accept != nil {
+        return h.Accept(c)
+    }
+    return h.Next.OnAccept(c)
+}
+
+func (h * HandlerFuncs) OnMessage(c *Connection, p Packet) (bool) {
+    if h.Message != nil {
+        return h.Message(c, p)
+    }
+    return h.Next.OnMessage(c, p)
+}
+
+func (h * HandlerFuncs) OnTimeout(c *Connection) (bool) {
+    if h.Timeout != nil {
+        return h.Timeout(c)
+    }
+    return h.Next.OnTimeout(c)
+}
+
+func (h * HandlerFuncs) OnClose(c *Connection) {
+    if h.Close != nil {
+        h.Close(c)
+        return
+    }
+    h.Next.OnClose(c)
+}
+
+// Recover returns a middleware recovering from panics in the handler. A
+// panic in OnAccept, OnMessage or OnTimeout closes the connection. onPanic,
+// if not nil, is called with the recovered value.
+func Recover(onPanic func(c *Connection, v any)) (Middleware) {
+    return func(next ConnectionHandler) ConnectionHandler {
+        recovered := func(c *Connection, ok *bool) {
+            if v := recover(); v != nil {
+                *ok = false
+                if onPanic != nil {
+                    onPanic(c, v)
+                }
+            }
+        }
+        return &HandlerFuncs{
+            Next: next,
+            Accept: func(c *Connection) (ok bool) {
+                defer recovered(c, &ok)
+                return next.OnAccept(c)
+            },
+            Message: func(c *Connection, p Packet) (ok bool) {
+                defer recovered(c, &ok)
+                return next.OnMessage(c, p)
+            },
+            Timeout: func(c *Connection) (ok bool) {
+                defer recovered(c, &ok)
+                return next.OnTimeout(c)
+            },
+            Close: func(c *Connection) {
+                var ok bool
+                defer recovered(c, &ok)
+                next.OnClose(c)
+            },
+        }
+    }
+}
+
+// Logging returns a middleware logging the life of connections to logger:
+// accepts, rejections, timeouts and closes at info level, every message at
+// debug level.
+func Logging(logger *slog.Logger) (Middleware) {
+    return func(next ConnectionHandler) ConnectionHandler {
+        attrs := func(c *Connection) slog.Attr {
+            return slog.Group("conn", slog.Uint64("id", c.ID()), slog.String("remote", c.RemoteAddrString()))
+        }
+        return &HandlerFuncs{
+            Next: next,
+            Accept: func(c *Connection) bool {
+                ok := next.OnAccept(c)
+                if ok {
+                    logger.LogAttrs(context.Background(), slog.LevelInfo, "connection accepted", attrs(c))
+                } else {
+                    logger.LogAttrs(context.Background(), slog.LevelInfo, "connection rejected", attrs(c))
+                }
+                return ok
+            },
+            Message: func(c *Connection, p Packet) bool {
+                logger.LogAttrs(context.Background(), slog.LevelDebug, "message received", attrs(c),
+                    slog.String("type", packetTypeName(p)))
+                return next.OnMessage(c, p)
+            },
+            Timeout: func(c *Connection) bool {
+                ok := next.OnTimeout(c)
+                logger.LogAttrs(context.Background(), slog.LevelInfo, "connection timeout", attrs(c),
+                    slog.String("kind", c.TimeoutKind().String()), slog.Bool("kept", ok))
+                return ok
+            },
+            Close: func(c *Connection) {
+                next.OnClose(c)
+                reason := slog.String("reason", c.CloseReason().String())
+                if err := c.Err(); err != nil {
+                    logger.LogAttrs(context.Background(), slog.LevelInfo, "connection closed", attrs(c),
+                        reason, slog.String("error", err.Error()))
+                    return
+                }
+                logger.LogAttrs(context.Background(), slog.LevelInfo, "connection closed", attrs(c), reason)
+            },
+        }
+    }
+}
+
+// Timing returns a middleware measuring how long OnMessage takes for each
+// packet and reporting it to observe.
+func Timing(observe func(c *Connection, p Packet, d time.Duration)) (Middleware) {
+    return func(next ConnectionHandler) ConnectionHandler {
+        return &HandlerFuncs{
+            Next: next,
+            Message: func(c *Connection, p Packet) bool {
+                start := time.Now()
+                defer func() {
+                    observe(c, p, time.Since(start))
+                }()
+                return next.OnMessage(c, p)
+            },
+        }
+    }
+}
+
+func packetTypeName(p Packet) (string) {
+    if m, ok := p.(*Message); ok {
+        return m.Type
+    }
+    return reflect.TypeOf(p).String()
+}
@@ -0,0 +1,95 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "bytes"
+    "strings"
+    "testing"
+    "log/slog"
+)
+
+type PanicHandler struct {
+    ShutdownAwareHandler
+}
+
+func (h * PanicHandler) OnMessage(c *Connection, p Packet) bool {
+    panic("boom")
+}
+
+func TestMiddlewareChain(t *testing.T) {
+    var calls []string
+    tag := func(name string) Middleware {
+        return func(next ConnectionHandler) ConnectionHandler {
+            return &HandlerFuncs{
+                Next: next,
+                Message: func(c *Connection, p Packet) bool {
+                    calls = append(calls, name)
+                    return next.OnMessage(c, p)
+                },
+            }
+        }
+    }
+
+    var panicked any
+    var timed time.Duration
+    var logs bytes.Buffer
+    logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+    h := Chain(&PanicHandler{},
+        Logging(logger),
+        Recover(func(c *Connection, v any) { panicked = v }),
+        Timing(func(c *Connection, p Packet, d time.Duration) { timed = d }),
+        tag("outer"), tag("inner"))
+    if _, ok := h.(ShutdownHandler); !ok {
+        t.Fatal("chain lost the ShutdownHandler of the wrapped handler")
+    }
+
+    local, remote := net.Pipe()
+    defer remote.Close()
+    c := NewConnection(nil, local)
+    c.handler = h
+
+    if !h.OnAccept(c) {
+        t.Fatal("connection was rejected")
+    }
+    if h.OnMessage(c, RawPacket("x")) {
+        t.Fatal("panicking message did not close the connection")
+    }
+    if panicked != "boom" {
+        t.Fatal("panic was not reported: ", panicked)
+    }
+    if timed <= 0 {
+        t.Fatal("message was not timed")
+    }
+    if strings.Join(calls, ",") != "outer,inner" {
+        t.Fatal(calls)
+    }
+    c.Close()
+
+    for _, line := range []string{"connection accepted", "message received", "connection closed"} {
+        if !strings.Contains(logs.String(), line) {
+            t.Fatal("missing log line ", line, " in:\n", logs.String())
+        }
+    }
+}
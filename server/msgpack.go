@@ -0,0 +1,626 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "fmt"
+    "math"
+    "errors"
+    "reflect"
+    "strings"
+    "encoding/binary"
+)
+
+// msgpackMaxDepth bounds the nesting of arrays and maps, so that a hostile
+// payload cannot exhaust the stack.
+const msgpackMaxDepth = 10000
+
+var(
+    errMsgpackShort = errors.New("msgpack: unexpected end of data")
+    errMsgpackDepth = errors.New("msgpack: exceeded max depth")
+)
+
+// MsgpackCodec is a Codec using the MessagePack format. Structs are encoded
+// as maps keyed by field name; the `msgpack:"name,omitempty"` field tag
+// renames or omits fields, "-" skips them.
+type MsgpackCodec struct {}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) {
+    return msgpackAppend(nil, reflect.ValueOf(v))
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v any) (error) {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Pointer || rv.IsNil() {
+        return fmt.Errorf("msgpack: Unmarshal needs a non-nil pointer, got %T", v)
+    }
+    d := &msgpackDecoder{data: data}
+    x, err := d.decode()
+    if err != nil {
+        return err
+    }
+    if d.pos != len(d.data) {
+        return fmt.Errorf("msgpack: %d trailing bytes", len(d.data) - d.pos)
+    }
+    return msgpackAssign(rv.Elem(), x)
+}
+
+/****************************************
+** Encoding
+****************************************/
+
+func msgpackAppend(b []byte, v reflect.Value) ([]byte, error) {
+    if !v.IsValid() {
+        return append(b, 0xc0), nil
+    }
+    switch v.Kind() {
+    case reflect.Pointer, reflect.Interface:
+        if v.IsNil() {
+            return append(b, 0xc0), nil
+        }
+        return msgpackAppend(b, v.Elem())
+    case reflect.Bool:
+        if v.Bool() {
+            return append(b, 0xc3), nil
+        }
+        return append(b, 0xc2), nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return msgpackAppendInt(b, v.Int()), nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return msgpackAppendUint(b, v.Uint()), nil
+    case reflect.Float32:
+        b = append(b, 0xca)
+        return binary.BigEndian.AppendUint32(b, math.Float32bits(float32(v.Float()))), nil
+    case reflect.Float64:
+        b = append(b, 0xcb)
+        return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+    case reflect.String:
+        return msgpackAppendString(b, v.String()), nil
+    case reflect.Slice:
+        if v.IsNil() {
+            return append(b, 0xc0), nil
+        }
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            return msgpackAppendBytes(b, v.Bytes()), nil
+        }
+        return msgpackAppendArray(b, v)
+    case reflect.Array:
+        return msgpackAppendArray(b, v)
+    case reflect.Map:
+        if v.IsNil() {
+            return append(b, 0xc0), nil
+        }
+        b = msgpackAppendHeader(b, v.Len(), 0x80, 15, 0xde, 0xdf)
+        var err error
+        iter := v.MapRange()
+        for iter.Next() {
+            if b, err = msgpackAppend(b, iter.Key()); err != nil {
+                return nil, err
+            }
+            if b, err = msgpackAppend(b, iter.Value()); err != nil {
+                return nil, err
+            }
+        }
+        return b, nil
+    case reflect.Struct:
+        return msgpackAppendStruct(b, v)
+    }
+    return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+func msgpackAppendInt(b []byte, i int64) ([]byte) {
+    switch {
+    case i >= 0:
+        return msgpackAppendUint(b, uint64(i))
+    case i >= -32:
+        return append(b, byte(i))
+    case i >= math.MinInt8:
+        return append(b, 0xd0, byte(i))
+    case i >= math.MinInt16:
+        return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+    case i >= math.MinInt32:
+        return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+    }
+    return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
+
+func msgpackAppendUint(b []byte, u uint64) ([]byte) {
+    switch {
+    case u <= 0x7f:
+        return append(b, byte(u))
+    case u <= math.MaxUint8:
+        return append(b, 0xcc, byte(u))
+    case u <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(u))
+    case u <= math.MaxUint32:
+        return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(u))
+    }
+    return binary.BigEndian.AppendUint64(append(b, 0xcf), u)
+}
+
+func msgpackAppendString(b []byte, s string) ([]byte) {
+    if len(s) <= 31 {
+        b = append(b, 0xa0 | byte(len(s)))
+    } else if len(s) <= math.MaxUint8 {
+        b = append(b, 0xd9, byte(len(s)))
+    } else {
+        b = msgpackAppendHeader(b, len(s), 0, -1, 0xda, 0xdb)
+    }
+    return append(b, s...)
+}
+
+func msgpackAppendBytes(b []byte, p []byte) ([]byte) {
+    if len(p) <= math.MaxUint8 {
+        b = append(b, 0xc4, byte(len(p)))
+    } else {
+        b = msgpackAppendHeader(b, len(p), 0, -1, 0xc5, 0xc6)
+    }
+    return append(b, p...)
+}
+
+// msgpackAppendHeader appends the header of a container of n elements,
+// using the fix format for n <= fixMax and the 16 or 32 bits format above.
+func msgpackAppendHeader(b []byte, n int, fix byte, fixMax int, code16, code32 byte) ([]byte) {
+    switch {
+    case n <= fixMax:
+        return append(b, fix | byte(n))
+    case n <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, code16), uint16(n))
+    }
+    return binary.BigEndian.AppendUint32(append(b, code32), uint32(n))
+}
+
+func msgpackAppendArray(b []byte, v reflect.Value) (_ []byte, err error) {
+    b = msgpackAppendHeader(b, v.Len(), 0x90, 15, 0xdc, 0xdd)
+    for i := 0; i < v.Len(); i++ {
+        if b, err = msgpackAppend(b, v.Index(i)); err != nil {
+            return nil, err
+        }
+    }
+    return b, nil
+}
+
+func msgpackAppendStruct(b []byte, v reflect.Value) (_ []byte, err error) {
+    fields := msgpackFields(v.Type())
+    n := 0
+    for _, f := range fields {
+        if !f.omitEmpty || !v.Field(f.index).IsZero() {
+            n++
+        }
+    }
+    b = msgpackAppendHeader(b, n, 0x80, 15, 0xde, 0xdf)
+    for _, f := range fields {
+        fv := v.Field(f.index)
+        if f.omitEmpty && fv.IsZero() {
+            continue
+        }
+        b = msgpackAppendString(b, f.name)
+        if b, err = msgpackAppend(b, fv); err != nil {
+            return nil, err
+        }
+    }
+    return b, nil
+}
+
+type msgpackField struct {
+    name        string
+    index       int
+    omitEmpty   bool
+}
+
+func msgpackFields(t reflect.Type) (fields []msgpackField) {
+    for i := 0; i < t.NumField(); i++ {
+        sf := t.Field(i)
+        if !sf.IsExported() {
+            continue
+        }
+        f := msgpackField{name: sf.Name, index: i}
+        if tag, ok := sf.Tag.Lookup("msgpack"); ok {
+            if tag == "-" {
+                continue
+            }
+            name, opts, _ := strings.Cut(tag, ",")
+            if name != "" {
+                f.name = name
+            }
+            f.omitEmpty = opts == "omitempty"
+        }
+        fields = append(fields, f)
+    }
+    return
+}
+
+/****************************************
+** Decoding
+****************************************/
+
+type msgpackEntry struct {
+    key     any
+    value   any
+}
+
+// msgpackDecoder decodes MessagePack data into a tree of nil, bool, int64,
+// uint64, float32, float64, string, []byte, []any and []msgpackEntry values,
+// assigned afterwards to the destination by msgpackAssign.
+type msgpackDecoder struct {
+    data    []byte
+    pos     int
+    depth   int
+}
+
+func (d * msgpackDecoder) next(n int) ([]byte, error) {
+    if n < 0 || len(d.data) - d.pos < n {
+        return nil, errMsgpackShort
+    }
+    b := d.data[d.pos:d.pos + n]
+    d.pos += n
+    return b, nil
+}
+
+func (d * msgpackDecoder) uint(n int) (uint64, error) {
+    b, err := d.next(n)
+    if err != nil {
+        return 0, err
+    }
+    switch n {
+    case 1:
+        return uint64(b[0]), nil
+    case 2:
+        return uint64(binary.BigEndian.Uint16(b)), nil
+    case 4:
+        return uint64(binary.BigEndian.Uint32(b)), nil
+    }
+    return binary.BigEndian.Uint64(b), nil
+}
+
+func (d * msgpackDecoder) decode() (any, error) {
+    b, err := d.next(1)
+    if err != nil {
+        return nil, err
+    }
+    code := b[0]
+    switch {
+    case code <= 0x7f:
+        return int64(code), nil
+    case code >= 0xe0:
+        return int64(int8(code)), nil
+    case code & 0xf0 == 0x80:
+        return d.decodeMap(int(code & 0x0f))
+    case code & 0xf0 == 0x90:
+        return d.decodeArray(int(code & 0x0f))
+    case code & 0xe0 == 0xa0:
+        return d.decodeString(int(code & 0x1f))
+    }
+
+    switch code {
+    case 0xc0:
+        return nil, nil
+    case 0xc2:
+        return false, nil
+    case 0xc3:
+        return true, nil
+    case 0xc4, 0xc5, 0xc6:
+        n, err := d.uint(1 << (code - 0xc4))
+        if err != nil {
+            return nil, err
+        }
+        p, err := d.next(int(n))
+        if err != nil {
+            return nil, err
+        }
+        return append([]byte(nil), p...), nil
+    case 0xca:
+        u, err := d.uint(4)
+        return math.Float32frombits(uint32(u)), err
+    case 0xcb:
+        u, err := d.uint(8)
+        return math.Float64frombits(u), err
+    case 0xcc, 0xcd, 0xce, 0xcf:
+        return d.uint(1 << (code - 0xcc))
+    case 0xd0, 0xd1, 0xd2, 0xd3:
+        size := 1 << (code - 0xd0)
+        u, err := d.uint(size)
+        shift := 64 - 8 * size
+        return int64(u << shift) >> shift, err
+    case 0xd9, 0xda, 0xdb:
+        n, err := d.uint(1 << (code - 0xd9))
+        if err != nil {
+            return nil, err
+        }
+        return d.decodeString(int(n))
+    case 0xdc, 0xdd:
+        n, err := d.uint(2 << (code - 0xdc))
+        if err != nil {
+            return nil, err
+        }
+        return d.decodeArray(int(n))
+    case 0xde, 0xdf:
+        n, err := d.uint(2 << (code - 0xde))
+        if err != nil {
+            return nil, err
+        }
+        return d.decodeMap(int(n))
+    }
+    return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", code)
+}
+
+func (d * msgpackDecoder) decodeString(n int) (any, error) {
+    b, err := d.next(n)
+    if err != nil {
+        return nil, err
+    }
+    return string(b), nil
+}
+
+func (d * msgpackDecoder) enter() (error) {
+    if d.depth++; d.depth > msgpackMaxDepth {
+        return errMsgpackDepth
+    }
+    return nil
+}
+
+func (d * msgpackDecoder) decodeArray(n int) (any, error) {
+    if n > len(d.data) - d.pos {
+        return nil, errMsgpackShort
+    }
+    if err := d.enter(); err != nil {
+        return nil, err
+    }
+    defer func() { d.depth-- }()
+    a := make([]any, n)
+    for i := range a {
+        x, err := d.decode()
+        if err != nil {
+            return nil, err
+        }
+        a[i] = x
+    }
+    return a, nil
+}
+
+func (d * msgpackDecoder) decodeMap(n int) (any, error) {
+    if n > (len(d.data) - d.pos) / 2 {
+        return nil, errMsgpackShort
+    }
+    if err := d.enter(); err != nil {
+        return nil, err
+    }
+    defer func() { d.depth-- }()
+    m := make([]msgpackEntry, n)
+    for i := range m {
+        k, err := d.decode()
+        if err != nil {
+            return nil, err
+        }
+        v, err := d.decode()
+        if err != nil {
+            return nil, err
+        }
+        m[i] = msgpackEntry{k, v}
+    }
+    return m, nil
+}
+
+func msgpackAssign(v reflect.Value, x any) (error) {
+    if x == nil {
+        v.SetZero()
+        return nil
+    }
+
+    switch v.Kind() {
+    case reflect.Interface:
+        if v.NumMethod() != 0 {
+            break
+        }
+        v.Set(reflect.ValueOf(msgpackNatural(x)))
+        return nil
+    case reflect.Pointer:
+        if v.IsNil() {
+            v.Set(reflect.New(v.Type().Elem()))
+        }
+        return msgpackAssign(v.Elem(), x)
+    case reflect.Bool:
+        if b, ok := x.(bool); ok {
+            v.SetBool(b)
+            return nil
+        }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        var i int64
+        switch n := x.(type) {
+        case int64:
+            i = n
+        case uint64:
+            if n > math.MaxInt64 {
+                return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+            }
+            i = int64(n)
+        default:
+            return msgpackTypeError(v, x)
+        }
+        if v.OverflowInt(i) {
+            return fmt.Errorf("msgpack: %d overflows %s", i, v.Type())
+        }
+        v.SetInt(i)
+        return nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        var u uint64
+        switch n := x.(type) {
+        case uint64:
+            u = n
+        case int64:
+            if n < 0 {
+                return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+            }
+            u = uint64(n)
+        default:
+            return msgpackTypeError(v, x)
+        }
+        if v.OverflowUint(u) {
+            return fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+        }
+        v.SetUint(u)
+        return nil
+    case reflect.Float32, reflect.Float64:
+        switch n := x.(type) {
+        case float32:
+            v.SetFloat(float64(n))
+        case float64:
+            v.SetFloat(n)
+        case int64:
+            v.SetFloat(float64(n))
+        case uint64:
+            v.SetFloat(float64(n))
+        default:
+            return msgpackTypeError(v, x)
+        }
+        return nil
+    case reflect.String:
+        switch s := x.(type) {
+        case string:
+            v.SetString(s)
+            return nil
+        case []byte:
+            v.SetString(string(s))
+            return nil
+        }
+    case reflect.Slice:
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            switch s := x.(type) {
+            case []byte:
+                v.SetBytes(s)
+                return nil
+            case string:
+                v.SetBytes([]byte(s))
+                return nil
+            }
+        }
+        a, ok := x.([]any)
+        if !ok {
+            break
+        }
+        s := reflect.MakeSlice(v.Type(), len(a), len(a))
+        for i := range a {
+            if err := msgpackAssign(s.Index(i), a[i]); err != nil {
+                return err
+            }
+        }
+        v.Set(s)
+        return nil
+    case reflect.Array:
+        a, ok := x.([]any)
+        if !ok || len(a) > v.Len() {
+            break
+        }
+        v.SetZero()
+        for i := range a {
+            if err := msgpackAssign(v.Index(i), a[i]); err != nil {
+                return err
+            }
+        }
+        return nil
+    case reflect.Map:
+        m, ok := x.([]msgpackEntry)
+        if !ok {
+            break
+        }
+        mv := reflect.MakeMapWithSize(v.Type(), len(m))
+        for _, e := range m {
+            k := reflect.New(v.Type().Key()).Elem()
+            if err := msgpackAssign(k, e.key); err != nil {
+                return err
+            }
+            ev := reflect.New(v.Type().Elem()).Elem()
+            if err := msgpackAssign(ev, e.value); err != nil {
+                return err
+            }
+            mv.SetMapIndex(k, ev)
+        }
+        v.Set(mv)
+        return nil
+    case reflect.Struct:
+        m, ok := x.([]msgpackEntry)
+        if !ok {
+            break
+        }
+        fields := msgpackFields(v.Type())
+        for _, e := range m {
+            name, ok := e.key.(string)
+            if !ok {
+                continue
+            }
+            for _, f := range fields {
+                if f.name == name {
+                    if err := msgpackAssign(v.Field(f.index), e.value); err != nil {
+                        return err
+                    }
+                    break
+                }
+            }
+        }
+        return nil
+    }
+    return msgpackTypeError(v, x)
+}
+
+// msgpackNatural converts a decoded value to the types used when decoding
+// into an empty interface: maps become map[string]any when all their keys
+// are strings and map[any]any otherwise.
+func msgpackNatural(x any) (any) {
+    switch n := x.(type) {
+    case []any:
+        for i := range n {
+            n[i] = msgpackNatural(n[i])
+        }
+        return n
+    case []msgpackEntry:
+        strKeys := true
+        for _, e := range n {
+            if _, ok := e.key.(string); !ok {
+                strKeys = false
+                break
+            }
+        }
+        if strKeys {
+            m := make(map[string]any, len(n))
+            for _, e := range n {
+                m[e.key.(string)] = msgpackNatural(e.value)
+            }
+            return m
+        }
+        m := make(map[any]any, len(n))
+        for _, e := range n {
+            k := msgpackNatural(e.key)
+            switch k.(type) {
+            case []byte:
+                k = string(k.([]byte))
+            case []any, map[string]any, map[any]any:
+                k = fmt.Sprint(k)
+            }
+            m[k] = msgpackNatural(e.value)
+        }
+        return m
+    }
+    return x
+}
+
+func msgpackTypeError(v reflect.Value, x any) (error) {
+    return fmt.Errorf("msgpack: cannot decode %T into %s", x, v.Type())
+}
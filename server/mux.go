@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "time"
+    "errors"
+    "crypto/tls"
+)
+
+var(
+    ErrNoMatch     = errors.New("no protocol matched the connection")
+    ErrNoTLSConfig = errors.New("no TLS configuration for the route")
+)
+
+// Matcher tells whether a connection speaks a protocol, by peeking at its
+// first bytes with Connection.Peek. Matchers should peek no more bytes than
+// they need, as a peer waiting for a reply sends no more.
+type Matcher func(c *Connection) bool
+
+// MatchAny matches every connection. It is meant for the last route of a
+// Mux.
+func MatchAny() (Matcher) {
+    return func(c *Connection) bool {
+        return true
+    }
+}
+
+// MatchPrefix matches the connections starting with one of prefixes.
+func MatchPrefix(prefixes ...[]byte) (Matcher) {
+    return func(c *Connection) bool {
+        for _, prefix := range prefixes {
+            if hasPrefix(c.reader, prefix) {
+                return true
+            }
+        }
+        return false
+    }
+}
+
+// MatchTLS matches the connections starting with a TLS handshake record.
+func MatchTLS() (Matcher) {
+    return MatchPrefix([]byte{0x16, 0x03})
+}
+
+type muxRoute struct {
+    match       Matcher
+    secure      bool
+    tlsConfig * tls.Config
+    protocol    Protocol
+    handler     ConnectionHandler
+}
+
+// Mux serves several protocols on a single listener. It peeks at the first
+// bytes of each accepted connection and hands it to the protocol and the
+// handler of the first route whose Matcher matches. Connections matching no
+// route are closed with ErrNoMatch, those sending nothing within the timeout
+// with CloseTimeout.
+type Mux struct {
+    routes  []muxRoute
+    timeout time.Duration
+}
+
+// NewMux creates a Mux waiting at most timeout for the bytes its matchers
+// need. A zero timeout waits forever.
+func NewMux(timeout time.Duration) (*Mux) {
+    return &Mux{timeout: timeout}
+}
+
+// Handle routes the connections matched by match to protocol and handler.
+// A nil protocol or handler stands for the one of the server.
+func (m * Mux) Handle(match Matcher, protocol Protocol, handler ConnectionHandler) {
+    m.routes = append(m.routes, muxRoute{match: match, protocol: protocol, handler: handler})
+}
+
+// HandleTLS is Handle for connections that must go through a TLS handshake
+// with config before being served, typically matched by MatchTLS. A nil
+// config stands for the TLS settings of the listener, connections of a
+// listener without TLS are then closed with ErrNoTLSConfig.
+func (m * Mux) HandleTLS(match Matcher, config *tls.Config, protocol Protocol, handler ConnectionHandler) {
+    m.routes = append(m.routes, muxRoute{match: match, secure: true, tlsConfig: config, protocol: protocol, handler: handler})
+}
+
+// route matches c against the routes of m and sets up c for the first one
+// matching.
+func (m * Mux) route(c *Connection) (CloseReason, error) {
+    if m.timeout > 0 {
+        c.conn.SetReadDeadline(time.Now().Add(m.timeout))
+        defer c.conn.SetReadDeadline(time.Time{})
+    }
+    if _, err := c.reader.Peek(1); err != nil {
+        if isTimeout(err) {
+            return CloseTimeout, err
+        }
+        return readCloseReason(err), err
+    }
+    for _, r := range m.routes {
+        if !r.match(c) {
+            continue
+        }
+        if r.protocol != nil {
+            c.protocol = r.protocol
+        }
+        if r.handler != nil {
+            c.handler = r.handler
+        }
+        if !r.secure {
+            return CloseNone, nil
+        }
+        config := r.tlsConfig
+        if config == nil && c.listener != nil {
+            config = c.listener.lateTLS
+        }
+        if config == nil {
+            return CloseProtocolError, ErrNoTLSConfig
+        }
+        c.startTLS(config)
+        return CloseNone, nil
+    }
+    return CloseProtocolError, ErrNoMatch
+}
+
+// Peek returns the next n bytes of the connection without consuming them.
+func (c * Connection) Peek(n int) ([]byte, error) {
+    return c.reader.Peek(n)
+}
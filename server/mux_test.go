@@ -0,0 +1,141 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "bufio"
+    "bytes"
+    "testing"
+    "crypto/tls"
+)
+
+type UpperHandler struct {
+    EchoHandler
+}
+
+func (h * UpperHandler) OnMessage(c *Connection, p Packet) bool {
+    c.Send(RawPacket(bytes.ToUpper(p.Serialize())))
+    return true
+}
+
+func TestMux(t *testing.T) {
+    ca := newTestCA(t)
+    _, key, der := ca.issue(t, "server", []string{"localhost"}, false)
+    config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+    mux := NewMux(200 * time.Millisecond)
+    mux.HandleTLS(MatchTLS(), config, nil, nil)
+    mux.Handle(MatchPrefix([]byte("admin ")), nil, &UpperHandler{})
+    mux.Handle(MatchPrefix([]byte("echo ")), nil, nil)
+    h := &SessionHandler{events: make(chan closeEvent, 8)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(64), WithMux(mux))
+    addr := startServer(t, s).String()
+    defer s.Stop()
+
+    tests := []struct{
+        send    string
+        reply   string
+        dial    func() (net.Conn, error)
+    }{
+        {"echo hi\n",   "echo hi\n",    func() (net.Conn, error) { return net.Dial("tcp", addr) }},
+        {"admin hi\n",  "ADMIN HI\n",   func() (net.Conn, error) { return net.Dial("tcp", addr) }},
+        {"echo tls\n",  "echo tls\n",   func() (net.Conn, error) {
+            return tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: ca.pool()})
+        }},
+    }
+    for _, tt := range tests {
+        conn, err := tt.dial()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.Write([]byte(tt.send))
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        reply, err := bufio.NewReader(conn).ReadString('\n')
+        if err != nil || reply != tt.reply {
+            t.Fatal(tt.send, ": ", reply, err)
+        }
+    }
+
+    for _, tt := range []struct{
+        send    string
+        reason  CloseReason
+    }{
+        {"",            CloseTimeout},
+        {"other\n",     CloseProtocolError},
+    } {
+        conn, err := net.Dial("tcp", addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.Write([]byte(tt.send))
+        select {
+        case ev := <-h.events:
+            if ev.reason != tt.reason {
+                t.Fatal(ev.reason, " != ", tt.reason)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("connection was not closed for ", tt.reason)
+        }
+    }
+}
+
+func TestMuxSecureServer(t *testing.T) {
+    ca := newTestCA(t)
+    certFile, keyFile := ca.writeKeyPair(t, t.TempDir(), "server", "localhost")
+    mux := NewMux(200 * time.Millisecond)
+    mux.HandleTLS(MatchTLS(), nil, nil, nil)
+    mux.Handle(MatchPrefix([]byte("admin ")), nil, &UpperHandler{})
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64),
+        WithCertFiles(certFile, keyFile), WithMux(mux))
+    addr := startServer(t, s).String()
+    defer s.Stop()
+
+    secure, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: ca.pool()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer secure.Close()
+    plain, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer plain.Close()
+
+    for _, tt := range []struct{
+        conn    net.Conn
+        send    string
+        reply   string
+    }{
+        {secure,    "echo tls\n",   "echo tls\n"},
+        {plain,     "admin hi\n",   "ADMIN HI\n"},
+    } {
+        tt.conn.Write([]byte(tt.send))
+        tt.conn.SetReadDeadline(time.Now().Add(time.Second))
+        reply, err := bufio.NewReader(tt.conn).ReadString('\n')
+        if err != nil || reply != tt.reply {
+            t.Fatal(tt.send, ": ", reply, err)
+        }
+    }
+}
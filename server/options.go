@@ -0,0 +1,257 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "net"
+    "time"
+    "crypto/tls"
+    "crypto/x509"
+    "github.com/kdruelle/gutils/trace"
+)
+
+// Option configures a Server created by NewServer.
+type Option func(*Server)
+
+// WithWorkers sets the number of workers of the server's pool. As every
+// connection holds a worker for its whole lifetime, this is also the number
+// of connections served concurrently. Defaults to 5, which an n of 0 or less
+// keeps.
+func WithWorkers(n int) (Option) {
+    return func(s *Server) {
+        if n > 0 {
+            s.workers = n
+        }
+    }
+}
+
+// WithQueueLength sets how many accepted connections can wait for a free
+// worker. Defaults to 100, which an n of 0 or less keeps.
+func WithQueueLength(n int) (Option) {
+    return func(s *Server) {
+        if n > 0 {
+            s.queueLength = n
+        }
+    }
+}
+
+// WithTLSConfig makes the server serve TLS using config.
+func WithTLSConfig(config *tls.Config) (Option) {
+    return func(s *Server) {
+        s.ssl = true
+        s.tlsConfig = config
+    }
+}
+
+// WithCertFiles makes the server serve TLS with the key pair loaded from
+// certFile and keyFile. It can be given several times, the certificate
+// presented to a client is then selected by SNI.
+func WithCertFiles(certFile, keyFile string) (Option) {
+    return func(s *Server) {
+        s.ssl = true
+        s.certFiles = append(s.certFiles, keyPairFile{cert: certFile, key: keyFile})
+    }
+}
+
+// WithCertReload reloads the certificate files when they change on disk,
+// checking every interval, and whenever the process receives SIGHUP. An
+// interval of 0 only reloads on SIGHUP.
+func WithCertReload(interval time.Duration) (Option) {
+    return func(s *Server) {
+        s.certReload = true
+        s.certInterval = interval
+    }
+}
+
+// WithClientCAs requires clients to present a certificate signed by one of
+// the authorities in pool.
+func WithClientCAs(pool *x509.CertPool) (Option) {
+    return func(s *Server) {
+        s.clientCAs = pool
+    }
+}
+
+// WithHandshakeTimeout bounds the TLS handshake. Defaults to 10 seconds.
+func WithHandshakeTimeout(d time.Duration) (Option) {
+    return func(s *Server) {
+        s.handshakeTimeout = d
+    }
+}
+
+// WithMaxConnections limits the number of connections held at once by the
+// server. Connections accepted beyond the limit are closed immediately. It is
+// a shorthand for the MaxConnections field of Limits.
+func WithMaxConnections(n int) (Option) {
+    return func(s *Server) {
+        s.limiter.MaxConnections = n
+    }
+}
+
+// WithIdleTimeout sets how long a connection may wait for the next packet.
+// When it expires, OnTimeout is called with TimeoutIdle and the connection
+// is kept if it returns true.
+func WithIdleTimeout(d time.Duration) (Option) {
+    return func(s *Server) {
+        s.idleTimeout = d
+    }
+}
+
+// WithReadTimeout sets how long reading a packet may take once its first
+// byte arrived. Without an idle timeout, it also bounds the wait for the
+// next packet. When it expires mid-packet, OnTimeout is called with
+// TimeoutRead and the connection is closed.
+func WithReadTimeout(d time.Duration) (Option) {
+    return func(s *Server) {
+        s.readTimeout = d
+    }
+}
+
+// WithWriteTimeout sets a write deadline re-armed before each write. When it
+// expires, OnTimeout is called with TimeoutWrite and the connection is
+// closed.
+func WithWriteTimeout(d time.Duration) (Option) {
+    return func(s *Server) {
+        s.writeTimeout = d
+    }
+}
+
+// WithSendQueue gives every connection a send queue, as if
+// Connection.EnableSendQueue was called before OnAccept.
+func WithSendQueue(depth int, policy OverflowPolicy) (Option) {
+    return func(s *Server) {
+        s.sendQueueDepth = depth
+        s.sendPolicy = policy
+    }
+}
+
+// WithHeartbeat makes the server ping every connection each interval, if its
+// protocol is a HeartbeatProtocol. A connection that leaves misses pings in
+// a row unanswered is closed with ErrHeartbeatTimeout. A misses of 0 or less
+// means 1.
+func WithHeartbeat(interval time.Duration, misses int) (Option) {
+    return func(s *Server) {
+        s.heartbeatInterval = interval
+        s.heartbeatMisses = misses
+    }
+}
+
+// WithLimits sets the admission control limits of the server. It overrides
+// WithMaxConnections.
+func WithLimits(limits Limits) (Option) {
+    return func(s *Server) {
+        s.limiter.Limits = limits
+    }
+}
+
+// WithLimitPolicy sets the policy applied when a limit fires. Defaults to
+// DefaultLimitPolicy.
+func WithLimitPolicy(policy LimitPolicy) (Option) {
+    return func(s *Server) {
+        s.limiter.policy = policy
+    }
+}
+
+// WithAccessList filters the remote addresses of accepted connections with
+// acl. Denied connections are closed before reaching the worker pool, or,
+// with the PROXY protocol, as soon as the client address of the header is
+// known. The rules may be reloaded at runtime with acl.SetRules.
+func WithAccessList(acl *AccessList) (Option) {
+    return func(s *Server) {
+        s.accessList = acl
+    }
+}
+
+// WithAccessDenied sets a function called with the remote address of each
+// connection denied by the access list.
+func WithAccessDenied(f func(addr net.Addr)) (Option) {
+    return func(s *Server) {
+        s.onAccessDenied = f
+    }
+}
+
+// WithProxyProtocol makes the server decode the PROXY protocol v1 or v2
+// header sent by a load balancer in front of it, exposing the real client
+// address through Connection.RemoteAddr. The access list and the per-IP
+// limits are applied to that address once the header is read, instead of to
+// the address of the load balancer. The header must arrive within the
+// handshake timeout.
+func WithProxyProtocol(mode ProxyProtocolMode) (Option) {
+    return func(s *Server) {
+        s.proxyMode = mode
+    }
+}
+
+// WithUnixSocket makes the server listen on a unix socket, the local address
+// being the path of the socket. A stale socket left by a previous process is
+// removed, while a socket still in use makes Start fail with
+// ErrSocketInUse. If perm is not zero, the socket file is given these
+// permissions. On Linux, a path starting with '@' is an abstract socket,
+// which has neither a file nor permissions.
+func WithUnixSocket(perm os.FileMode) (Option) {
+    return func(s *Server) {
+        s.unixSocket = true
+        s.socketPerm = perm
+    }
+}
+
+// WithDatagram makes Start serve UDP datagrams, or unix datagrams with
+// WithUnixSocket, instead of stream connections. See ServePacket. TLS and
+// the PROXY protocol do not apply to datagram servers.
+func WithDatagram() (Option) {
+    return func(s *Server) {
+        s.datagram = true
+    }
+}
+
+// WithListener adds a listener on addr to the server, served along with its
+// local address. name identifies the listener, for instance to tell the
+// connections of an admin port from the others in OnAccept.
+func WithListener(name, addr string, opts ...ListenerOption) (Option) {
+    return func(s *Server) {
+        l := &Listener{name: name, addr: addr}
+        for _, opt := range opts {
+            opt(l)
+        }
+        s.extraListeners = append(s.extraListeners, l)
+    }
+}
+
+// WithMux serves the connections accepted on the local address of the
+// server through mux, sniffing their first bytes to pick their protocol and
+// handler. It happens after the PROXY protocol header, if any, and before
+// any TLS handshake: on a secure server, only the connections of the routes
+// added with HandleTLS go through TLS, with the settings of the server if
+// the route has none, the others being served in the clear.
+func WithMux(mux *Mux) (Option) {
+    return func(s *Server) {
+        s.mux = mux
+    }
+}
+
+// WithTracer makes the server start spans with t around the admission of
+// each connection, the job serving it in the worker pool, and each
+// ReadPacket and OnMessage. Defaults to trace.Nop.
+func WithTracer(t trace.Tracer) (Option) {
+    return func(s *Server) {
+        s.tracer = t
+    }
+}
@@ -0,0 +1,72 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestMaxConnections(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{},
+        WithWorkers(2), WithMaxConnections(1))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    first := dialServer(t, addr)
+    defer first.Close()
+
+    second, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer second.Close()
+    second.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+        t.Fatal("connection beyond the limit was not closed: ", err)
+    }
+}
+
+func TestPoolOptionsDefaults(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{},
+        WithWorkers(0), WithQueueLength(-1))
+    if s.workers != 5 || s.queueLength != 100 {
+        t.Fatal(s.workers, " workers, queue of ", s.queueLength)
+    }
+    conn := dialServer(t, startServer(t, s))
+    defer conn.Close()
+    defer s.Stop()
+}
+
+func TestReadTimeoutOption(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{},
+        WithReadTimeout(time.Millisecond * 50))
+    conn := dialServer(t, startServer(t, s))
+    defer conn.Close()
+    defer s.Stop()
+
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+        t.Fatal("idle connection was not closed: ", err)
+    }
+}
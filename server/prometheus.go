@@ -0,0 +1,89 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "fmt"
+    "bufio"
+    "net/http"
+    "strconv"
+)
+
+// WritePrometheus writes the Stats of the server to w in the Prometheus text
+// exposition format. Metric names are prefixed with namespace and an
+// underscore if namespace is not empty.
+func (s * Server) WritePrometheus(w io.Writer, namespace string) (error) {
+    if namespace != "" {
+        namespace += "_"
+    }
+    st := s.Stats()
+    b := bufio.NewWriter(w)
+    metric := func(name, kind, help string, value any) {
+        name = namespace + name
+        fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+    }
+    metric("connections_accepted_total", "counter", "Connections accepted.", st.Accepted)
+    metric("connections_rejected_total", "counter", "Connections rejected by the access list, the limits or the handler.", st.Rejected)
+    metric("connections_active", "gauge", "Connections currently held.", st.Active)
+    metric("received_bytes_total", "counter", "Bytes received.", st.BytesIn)
+    metric("sent_bytes_total", "counter", "Bytes sent.", st.BytesOut)
+    metric("received_packets_total", "counter", "Packets received.", st.PacketsIn)
+    metric("sent_packets_total", "counter", "Packets sent.", st.PacketsOut)
+    metric("workers", "gauge", "Workers of the pool.", st.Workers)
+    metric("workers_busy", "gauge", "Workers serving a connection.", st.BusyWorkers)
+    metric("pool_queue_depth", "gauge", "Connections waiting for a worker.", st.QueueDepth)
+
+    name := namespace + "limit_hits_total"
+    fmt.Fprintf(b, "# HELP %s Times each limit fired.\n# TYPE %s counter\n", name, name)
+    hits := []uint64{
+        LimitConnections:       st.Limits.Connections,
+        LimitConnectionsPerIP:  st.Limits.ConnectionsPerIP,
+        LimitAcceptRate:        st.Limits.AcceptRate,
+        LimitAcceptRatePerIP:   st.Limits.AcceptRatePerIP,
+        LimitMessageRate:       st.Limits.MessageRate,
+    }
+    for kind, n := range hits {
+        fmt.Fprintf(b, "%s{limit=%q} %d\n", name, LimitKind(kind).String(), n)
+    }
+
+    h := st.MessageLatency
+    name = namespace + "message_duration_seconds"
+    fmt.Fprintf(b, "# HELP %s Time spent handling a message.\n# TYPE %s histogram\n", name, name)
+    var cumulative uint64
+    for i, bound := range h.Bounds {
+        cumulative += h.Counts[i]
+        le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+        fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, le, cumulative)
+    }
+    fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+    fmt.Fprintf(b, "%s_sum %v\n%s_count %d\n", name, h.Sum.Seconds(), name, h.Count)
+    return b.Flush()
+}
+
+// PrometheusHandler returns an http.Handler serving WritePrometheus, to be
+// mounted on the metrics endpoint scraped by Prometheus.
+func (s * Server) PrometheusHandler(namespace string) (http.Handler) {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        s.WritePrometheus(w, namespace)
+    })
+}
@@ -0,0 +1,369 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "bytes"
+    "bufio"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+    "crypto/tls"
+    "hash/crc32"
+    "encoding/binary"
+)
+
+var(
+    ErrProxyHeader   = errors.New("malformed PROXY protocol header")
+    ErrNoProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+var(
+    proxyV1Signature = []byte("PROXY ")
+    proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyProtocolMode tells a Server whether accepted connections start with
+// a PROXY protocol header, as sent by HAProxy and most L4 load balancers.
+type ProxyProtocolMode int
+
+const(
+    // ProxyProtocolOff does not look for a header.
+    ProxyProtocolOff ProxyProtocolMode = iota
+    // ProxyProtocolOptional decodes a header if there is one, and accepts
+    // connections without one.
+    ProxyProtocolOptional
+    // ProxyProtocolStrict closes the connections that do not start with a
+    // valid header.
+    ProxyProtocolStrict
+)
+
+// PROXY protocol v2 TLV types.
+const(
+    ProxyTLVALPN      byte = 0x01
+    ProxyTLVAuthority byte = 0x02
+    ProxyTLVCRC32C    byte = 0x03
+    ProxyTLVNoop      byte = 0x04
+    ProxyTLVUniqueID  byte = 0x05
+    ProxyTLVSSL       byte = 0x20
+    ProxyTLVNetNS     byte = 0x30
+)
+
+// ProxyTLV is a type-length-value extension of a PROXY protocol v2 header.
+type ProxyTLV struct {
+    Type    byte
+    Value   []byte
+}
+
+// ProxyHeader is a decoded PROXY protocol header.
+type ProxyHeader struct {
+    // Version is 1 for the text format and 2 for the binary one.
+    Version     int
+    // Local is true for connections established by the proxy itself, such
+    // as health checks, and for v1 UNKNOWN headers. Source and Destination
+    // are nil in that case.
+    Local       bool
+    Source      net.Addr
+    Destination net.Addr
+    // TLVs holds the v2 extensions, in the order they were received.
+    TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first extension of type t.
+func (h * ProxyHeader) TLV(t byte) ([]byte, bool) {
+    for _, tlv := range h.TLVs {
+        if tlv.Type == t {
+            return tlv.Value, true
+        }
+    }
+    return nil, false
+}
+
+// Authority returns the host name the client asked for, usually from SNI,
+// if the proxy sent it.
+func (h * ProxyHeader) Authority() (string) {
+    v, _ := h.TLV(ProxyTLVAuthority)
+    return string(v)
+}
+
+// ReadProxyHeader decodes a PROXY protocol v1 or v2 header from r. It
+// returns ErrNoProxyHeader, without consuming anything, if r does not start
+// with a header.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+    switch {
+    case hasPrefix(r, proxyV2Signature):
+        return readProxyV2(r)
+    case hasPrefix(r, proxyV1Signature):
+        return readProxyV1(r)
+    }
+    return nil, ErrNoProxyHeader
+}
+
+// hasPrefix peeks at r one byte at a time, so that a short packet which is
+// not a header is not waited on.
+func hasPrefix(r *bufio.Reader, prefix []byte) (bool) {
+    for i := range prefix {
+        b, err := r.Peek(i + 1)
+        if err != nil || b[i] != prefix[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// readProxyV1 decodes "PROXY TCP4 src dst sport dport\r\n". A v1 header is
+// at most 107 bytes long.
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+    var line []byte
+    for len(line) < 107 {
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, unexpectedEOF(err)
+        }
+        line = append(line, b)
+        if b == '\n' {
+            break
+        }
+    }
+    if !bytes.HasSuffix(line, []byte("\r\n")) {
+        return nil, ErrProxyHeader
+    }
+    fields := strings.Split(string(line[:len(line) - 2]), " ")
+    h := &ProxyHeader{Version: 1}
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        h.Local = true
+        return h, nil
+    }
+    if len(fields) != 6 {
+        return nil, ErrProxyHeader
+    }
+    var err error
+    if h.Source, err = parseProxyV1Addr(fields[1], fields[2], fields[4]); err != nil {
+        return nil, err
+    }
+    if h.Destination, err = parseProxyV1Addr(fields[1], fields[3], fields[5]); err != nil {
+        return nil, err
+    }
+    return h, nil
+}
+
+func parseProxyV1Addr(family, host, port string) (net.Addr, error) {
+    ip := net.ParseIP(host)
+    if ip == nil || (family == "TCP4") != (ip.To4() != nil) || (family != "TCP4" && family != "TCP6") {
+        return nil, ErrProxyHeader
+    }
+    p, err := strconv.ParseUint(port, 10, 16)
+    if err != nil {
+        return nil, ErrProxyHeader
+    }
+    return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 decodes the binary header: the signature, the version and
+// command, the address family and transport, the length of the rest, the
+// addresses then the TLVs.
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+    head := make([]byte, 16)
+    if _, err := io.ReadFull(r, head); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    if head[12] >> 4 != 2 {
+        return nil, ErrProxyHeader
+    }
+    body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+
+    h := &ProxyHeader{Version: 2}
+    switch head[12] & 0x0f {
+    case 0:
+        h.Local = true
+    case 1:
+    default:
+        return nil, ErrProxyHeader
+    }
+
+    var size int
+    switch head[13] >> 4 {
+    case 0:
+        h.Local = true
+    case 1:
+        size = 12
+    case 2:
+        size = 36
+    case 3:
+        size = 216
+    default:
+        return nil, ErrProxyHeader
+    }
+    if len(body) < size {
+        return nil, ErrProxyHeader
+    }
+    if !h.Local {
+        h.Source, h.Destination = parseProxyV2Addrs(head[13], body[:size])
+    }
+
+    tlvs := body[size:]
+    for len(tlvs) > 0 {
+        if len(tlvs) < 3 {
+            return nil, ErrProxyHeader
+        }
+        n := int(binary.BigEndian.Uint16(tlvs[1:]))
+        if len(tlvs) < 3 + n {
+            return nil, ErrProxyHeader
+        }
+        h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3:3 + n]})
+        if tlvs[0] == ProxyTLVCRC32C && !checkProxyCRC(head, body, tlvs[3:3 + n]) {
+            return nil, ErrProxyHeader
+        }
+        tlvs = tlvs[3 + n:]
+    }
+    return h, nil
+}
+
+func parseProxyV2Addrs(family byte, b []byte) (src, dst net.Addr) {
+    udp := family & 0x0f == 2
+    addr := func(ip net.IP, port []byte) (net.Addr) {
+        p := int(binary.BigEndian.Uint16(port))
+        if udp {
+            return &net.UDPAddr{IP: ip, Port: p}
+        }
+        return &net.TCPAddr{IP: ip, Port: p}
+    }
+    switch family >> 4 {
+    case 1:
+        return addr(net.IP(b[0:4]), b[8:10]), addr(net.IP(b[4:8]), b[10:12])
+    case 2:
+        return addr(net.IP(b[0:16]), b[32:34]), addr(net.IP(b[16:32]), b[34:36])
+    }
+    network := "unix"
+    if udp {
+        network = "unixgram"
+    }
+    name := func(b []byte) (string) {
+        if i := bytes.IndexByte(b, 0); i >= 0 {
+            b = b[:i]
+        }
+        return string(b)
+    }
+    return &net.UnixAddr{Name: name(b[:108]), Net: network}, &net.UnixAddr{Name: name(b[108:]), Net: network}
+}
+
+// checkProxyCRC verifies the CRC32C of the header, computed with the
+// checksum field set to zero.
+func checkProxyCRC(head, body, sum []byte) (bool) {
+    if len(sum) != 4 {
+        return false
+    }
+    want := binary.BigEndian.Uint32(sum)
+    copy(sum, []byte{0, 0, 0, 0})
+    defer binary.BigEndian.PutUint32(sum, want)
+    table := crc32.MakeTable(crc32.Castagnoli)
+    crc := crc32.Update(crc32.Checksum(head, table), table, body)
+    return crc == want
+}
+
+// ProxyHeader returns the PROXY protocol header the connection started
+// with, or nil.
+func (c * Connection) ProxyHeader() (*ProxyHeader) {
+    return c.proxy
+}
+
+// RemoteAddr returns the address of the peer. Behind a proxy speaking the
+// PROXY protocol, this is the address of the original client.
+func (c * Connection) RemoteAddr() (net.Addr) {
+    if c.proxy != nil && c.proxy.Source != nil {
+        return c.proxy.Source
+    }
+    return c.conn.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection. Behind a proxy
+// speaking the PROXY protocol, this is the address the client connected to.
+func (c * Connection) LocalAddr() (net.Addr) {
+    if c.proxy != nil && c.proxy.Destination != nil {
+        return c.proxy.Destination
+    }
+    return c.conn.LocalAddr()
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into a
+// buffer.
+type bufferedConn struct {
+    net.Conn
+    r io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+    return c.r.Read(b)
+}
+
+// proxied reports whether c was accepted on a listener using the PROXY
+// protocol.
+func (c * Connection) proxied() (bool) {
+    return c.listener != nil && c.listener.proxyMode != ProxyProtocolOff
+}
+
+// readProxyHeader decodes the PROXY protocol header of a server connection,
+// then applies the access list and the per-IP limits to the real client
+// address, or to the address of the peer if the header has none.
+func (c * Connection) readProxyHeader() (error) {
+    s := c.server
+    l := c.listener
+    if s == nil || !c.proxied() {
+        return nil
+    }
+    if c.opts.handshakeTimeout > 0 {
+        c.conn.SetReadDeadline(time.Now().Add(c.opts.handshakeTimeout))
+    }
+    h, err := ReadProxyHeader(c.reader)
+    c.conn.SetReadDeadline(time.Time{})
+    switch {
+    case err == ErrNoProxyHeader && l.proxyMode == ProxyProtocolOptional:
+    case err != nil:
+        return err
+    default:
+        c.proxy = h
+    }
+
+    src := c.conn.RemoteAddr()
+    if c.proxy != nil && c.proxy.Source != nil {
+        src = c.proxy.Source
+    }
+    if !s.allowed(src) || !s.admitSource(c, src) {
+        s.metrics.rejected.Add(1)
+        return ErrRejected
+    }
+    return nil
+}
+
+// startTLS makes c a server-side TLS connection, after bytes were read from
+// the underlying connection. The handshake is done by the first read.
+func (c * Connection) startTLS(config *tls.Config) {
+    buffered, _ := c.reader.Peek(c.reader.Buffered())
+    r := io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), c.conn)
+    c.conn = tls.Server(bufferedConn{c.conn, r}, config)
+    c.resetIO(defaultBufferSize)
+}
@@ -0,0 +1,199 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "bufio"
+    "bytes"
+    "testing"
+    "crypto/tls"
+    "hash/crc32"
+    "encoding/binary"
+)
+
+func proxyV2Header(tlvs ...ProxyTLV) ([]byte) {
+    body := []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0x01, 0xbb}
+    for _, tlv := range tlvs {
+        body = append(body, tlv.Type, byte(len(tlv.Value) >> 8), byte(len(tlv.Value)))
+        body = append(body, tlv.Value...)
+    }
+    b := append([]byte{}, proxyV2Signature...)
+    b = append(b, 0x21, 0x11, byte(len(body) >> 8), byte(len(body)))
+    return append(b, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+    r := bufio.NewReader(bytes.NewBufferString("PROXY TCP6 2001:db8::1 ::1 4242 80\r\nhello"))
+    h, err := ReadProxyHeader(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if h.Version != 1 || h.Source.String() != "[2001:db8::1]:4242" || h.Destination.String() != "[::1]:80" {
+        t.Fatal(h.Version, " ", h.Source, " ", h.Destination)
+    }
+    if rest, _ := r.ReadString(0); rest != "hello" {
+        t.Fatal("payload after header: ", rest)
+    }
+
+    b := proxyV2Header(ProxyTLV{ProxyTLVAuthority, []byte("example.com")}, ProxyTLV{ProxyTLVCRC32C, make([]byte, 4)})
+    crc := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+    binary.BigEndian.PutUint32(b[len(b) - 4:], crc)
+    h, err = ReadProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if h.Version != 2 || h.Source.String() != "192.0.2.1:12345" || h.Destination.String() != "198.51.100.7:443" {
+        t.Fatal(h.Version, " ", h.Source, " ", h.Destination)
+    }
+    if h.Authority() != "example.com" {
+        t.Fatal("authority: ", h.Authority())
+    }
+
+    b[len(b) - 1]++
+    if _, err = ReadProxyHeader(bufio.NewReader(bytes.NewReader(b))); err != ErrProxyHeader {
+        t.Fatal("bad checksum: ", err)
+    }
+    if _, err = ReadProxyHeader(bufio.NewReader(bytes.NewBufferString("PROXY TCP4 1.2.3.4\r\n"))); err != ErrProxyHeader {
+        t.Fatal("short v1 header: ", err)
+    }
+    if _, err = ReadProxyHeader(bufio.NewReader(bytes.NewBufferString("hi\n"))); err != ErrNoProxyHeader {
+        t.Fatal("no header: ", err)
+    }
+}
+
+type AddrHandler struct {
+    EchoHandler
+    addrs chan string
+}
+
+func (h * AddrHandler) OnAccept(c *Connection) bool {
+    h.addrs <- c.RemoteAddr().String()
+    return true
+}
+
+func TestProxyProtocolServer(t *testing.T) {
+    h := &AddrHandler{addrs: make(chan string, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(64), WithProxyProtocol(ProxyProtocolStrict))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.Write([]byte("PROXY TCP4 203.0.113.9 10.0.0.1 5555 80\r\nping\n"))
+    select {
+    case a := <-h.addrs:
+        if a != "203.0.113.9:5555" {
+            t.Fatal("remote address: ", a)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("connection was not accepted")
+    }
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil || line != "ping\n" {
+        t.Fatal(line, err)
+    }
+
+    strict, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer strict.Close()
+    strict.Write([]byte("ping\n"))
+    strict.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := strict.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+        t.Fatal("connection without header was not closed: ", err)
+    }
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+    ca := newTestCA(t)
+    certFile, keyFile := ca.writeKeyPair(t, t.TempDir(), "server", "localhost")
+    h := &AddrHandler{addrs: make(chan string, 1)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(64),
+        WithCertFiles(certFile, keyFile), WithProxyProtocol(ProxyProtocolOptional))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    raw, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw.Write(proxyV2Header())
+    conn := tls.Client(raw, &tls.Config{ServerName: "localhost", RootCAs: ca.pool()})
+    defer conn.Close()
+    if err := conn.Handshake(); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case a := <-h.addrs:
+        if a != "192.0.2.1:12345" {
+            t.Fatal("remote address: ", a)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("connection was not accepted")
+    }
+}
+
+func TestProxyProtocolClientLimits(t *testing.T) {
+    acl, err := NewAccessList([]string{"203.0.113.0/24"}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64),
+        WithProxyProtocol(ProxyProtocolStrict), WithAccessList(acl),
+        WithLimits(Limits{MaxConnectionsPerIP: 1}))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    tests := []struct{
+        source      string
+        accepted    bool
+    }{
+        {"203.0.113.9",     true},
+        {"203.0.113.10",    true},
+        {"203.0.113.9",     false},
+        {"198.51.100.1",    false},
+    }
+    for _, tt := range tests {
+        conn, err := net.Dial("tcp", addr.String())
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.Write([]byte("PROXY TCP4 " + tt.source + " 10.0.0.1 5555 80\r\nping\n"))
+        conn.SetReadDeadline(time.Now().Add(time.Second))
+        line, err := bufio.NewReader(conn).ReadString('\n')
+        if tt.accepted && (err != nil || line != "ping\n") {
+            t.Fatal(tt.source, ": client was not served: ", line, err)
+        }
+        if !tt.accepted && (err == nil || isTimeout(err)) {
+            t.Fatal(tt.source, ": client was not rejected: ", err)
+        }
+    }
+    if st := s.LimitStats(); st.ConnectionsPerIP != 1 {
+        t.Fatal("limit fired ", st.ConnectionsPerIP, " times")
+    }
+}
@@ -0,0 +1,212 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "errors"
+    "time"
+)
+
+var(
+    ErrQueueFull = errors.New("send queue is full")
+    ErrClosed    = errors.New("connection is closed")
+)
+
+// OverflowPolicy tells a connection's send queue what to do with a packet
+// that does not fit in the queue.
+type OverflowPolicy int
+
+const(
+    // OverflowBlock blocks the sender until there is room in the queue.
+    OverflowBlock OverflowPolicy = iota
+    // OverflowDropNewest discards the packet being sent.
+    OverflowDropNewest
+    // OverflowDropOldest discards the oldest queued packet to make room.
+    OverflowDropOldest
+    // OverflowDisconnect closes the connection of the slow consumer.
+    OverflowDisconnect
+)
+
+// drainTimeout bounds the time a connection closed by Close or rejected by
+// its handler spends writing its send queue when it has no write timeout.
+const drainTimeout = 5 * time.Second
+
+// EnableSendQueue gives the connection an outbound queue of depth packets,
+// drained by a dedicated writer goroutine, so that Send never waits on the
+// peer. It must be called before the connection is shared with other
+// goroutines, typically from OnAccept. Subsequent calls are no-ops. A depth
+// less than 1 means 1.
+//
+// When the connection is closed by Close or rejected by its handler, the
+// packets still queued are written before the socket is closed, within the
+// write timeout, or 5 seconds if there is none. On any other close reason
+// they are discarded.
+func (c * Connection) EnableSendQueue(depth int, policy OverflowPolicy) {
+    if c.sendQueue != nil {
+        return
+    }
+    c.sendQueue = make(chan []byte, max(depth, 1))
+    c.sendPolicy = policy
+    c.writeDone = make(chan struct{})
+    go c.writeLoop()
+}
+
+// Send serializes p and writes it to the peer, through the send queue if
+// the connection has one. If the connection's protocol is a PacketEncoder,
+// the packet is framed by the protocol.
+func (c * Connection) Send(p Packet) (error) {
+    b, err := encodePacket(c.protocol, p)
+    if err != nil {
+        return err
+    }
+    return c.send(b)
+}
+
+func (c * Connection) send(b []byte) (err error) {
+    if err = c.enqueue(b); err == nil {
+        c.countWrite(0, 1)
+    }
+    return
+}
+
+func (c * Connection) enqueue(b []byte) (error) {
+    if c.sendQueue == nil {
+        _, err := c.Write(b)
+        return err
+    }
+
+    select {
+    case <-c.closeChan:
+        return ErrClosed
+    default:
+    }
+
+    switch c.sendPolicy {
+    case OverflowDropNewest:
+        select {
+        case c.sendQueue <- b:
+            return nil
+        default:
+            return ErrQueueFull
+        }
+    case OverflowDropOldest:
+        for {
+            select {
+            case c.sendQueue <- b:
+                return nil
+            default:
+            }
+            select {
+            case <-c.sendQueue:
+            default:
+            }
+        }
+    case OverflowDisconnect:
+        select {
+        case c.sendQueue <- b:
+            return nil
+        default:
+            c.closeWith(CloseWriteError, ErrQueueFull)
+            return ErrQueueFull
+        }
+    }
+
+    select {
+    case c.sendQueue <- b:
+        return nil
+    case <-c.closeChan:
+        return ErrClosed
+    }
+}
+
+func (c * Connection) writeLoop() {
+    defer close(c.writeDone)
+    for {
+        select {
+        case <-c.closeChan:
+            if drainsQueue(c.CloseReason()) {
+                c.drainQueue()
+            }
+            return
+        case b := <-c.sendQueue:
+            if err := c.writeQueued(b); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// writeQueued writes b and whatever else is already queued before flushing,
+// so that a burst of packets costs a single flush. Datagram sessions flush
+// every packet, as each flush sends a datagram.
+func (c * Connection) writeQueued(b []byte) (err error) {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    c.armWriteDeadline()
+    defer func() {
+        c.checkWriteError(err)
+    }()
+    for {
+        if _, err = c.writer.Write(b); err != nil {
+            return
+        }
+        if c.datagram {
+            if err = c.writer.Flush(); err != nil {
+                return
+            }
+        }
+        select {
+        case b = <-c.sendQueue:
+            continue
+        default:
+        }
+        return c.writer.Flush()
+    }
+}
+
+// drainsQueue tells whether a connection closed for reason writes its queued
+// packets before closing the socket.
+func drainsQueue(reason CloseReason) (bool) {
+    return reason == CloseExplicit || reason == CloseRejected
+}
+
+// drainQueue writes the packets left in the send queue. The write deadline
+// is set by closeWith.
+func (c * Connection) drainQueue() {
+    c.writeMutex.Lock()
+    defer c.writeMutex.Unlock()
+    for {
+        select {
+        case b := <-c.sendQueue:
+            if _, err := c.writer.Write(b); err != nil {
+                return
+            }
+            if c.datagram {
+                if err := c.writer.Flush(); err != nil {
+                    return
+                }
+            }
+        default:
+            c.writer.Flush()
+            return
+        }
+    }
+}
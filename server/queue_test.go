@@ -0,0 +1,152 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestSendQueuePolicies(t *testing.T) {
+    tests := []struct{
+        policy      OverflowPolicy
+        lastErr     error
+        expect      string
+    }{
+        {OverflowBlock,      nil,          "abc"},
+        {OverflowDropNewest, ErrQueueFull, "ab"},
+        {OverflowDropOldest, nil,          "ac"},
+        {OverflowDisconnect, ErrQueueFull, ""},
+    }
+
+    for _, tt := range tests {
+        s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{})
+        local, remote := net.Pipe()
+        c := NewConnection(s, local)
+        c.EnableSendQueue(1, tt.policy)
+
+        c.Send(&TelnetPacket{[]byte("a")})
+        for len(c.sendQueue) > 0 {
+            time.Sleep(time.Millisecond)
+        }
+        if err := c.Send(&TelnetPacket{[]byte("b")}); err != nil {
+            t.Fatal(tt.policy, ": ", err)
+        }
+        errc := make(chan error, 1)
+        go func() {
+            errc <- c.Send(&TelnetPacket{[]byte("c")})
+        }()
+        if tt.policy == OverflowBlock {
+            select {
+            case err := <-errc:
+                t.Fatal(tt.policy, ": send did not block: ", err)
+            case <-time.After(20 * time.Millisecond):
+            }
+        } else if err := <-errc; err != tt.lastErr {
+            t.Fatal(tt.policy, ": ", err, " != ", tt.lastErr)
+        }
+
+        remote.SetReadDeadline(time.Now().Add(time.Second))
+        if tt.expect == "" {
+            if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+                t.Fatal(tt.policy, ": slow consumer was not disconnected: ", err)
+            }
+        }
+        b := make([]byte, len(tt.expect))
+        if _, err := io.ReadFull(remote, b); err != nil {
+            t.Fatal(tt.policy, ": ", err)
+        }
+        if string(b) != tt.expect {
+            t.Fatal(tt.policy, ": ", string(b), " != ", tt.expect)
+        }
+        if tt.policy == OverflowBlock {
+            if err := <-errc; err != tt.lastErr {
+                t.Fatal(tt.policy, ": ", err, " != ", tt.lastErr)
+            }
+        }
+        c.Close()
+        remote.Close()
+        s.Stop()
+    }
+}
+
+func TestSendQueueMinDepth(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{})
+    defer s.Stop()
+    local, remote := net.Pipe()
+    defer remote.Close()
+    c := NewConnection(s, local)
+    defer c.Close()
+    c.EnableSendQueue(0, OverflowDropOldest)
+
+    // The writer is stuck on "a", "c" replaces "b" in the queue.
+    errc := make(chan error, 1)
+    go func() {
+        for _, m := range []string{"a", "b", "c"} {
+            if err := c.Send(&TelnetPacket{[]byte(m)}); err != nil {
+                errc <- err
+                return
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+        errc <- nil
+    }()
+    select {
+    case err := <-errc:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("send spun on an empty queue")
+    }
+    remote.SetReadDeadline(time.Now().Add(time.Second))
+    b := make([]byte, 2)
+    if _, err := io.ReadFull(remote, b); err != nil || string(b) != "ac" {
+        t.Fatal(string(b), err)
+    }
+}
+
+func TestSendQueueDrainOnClose(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{})
+    defer s.Stop()
+    local, remote := net.Pipe()
+    defer remote.Close()
+    c := NewConnection(s, local)
+    c.EnableSendQueue(4, OverflowBlock)
+
+    for _, m := range []string{"a", "b", "c"} {
+        if err := c.Send(&TelnetPacket{[]byte(m)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    go c.Close()
+
+    remote.SetReadDeadline(time.Now().Add(time.Second))
+    b, err := io.ReadAll(remote)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(b) != "abc" {
+        t.Fatal("queued packets were lost on close: ", string(b))
+    }
+}
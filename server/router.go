@@ -0,0 +1,145 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "sync"
+    "reflect"
+)
+
+// Typed is implemented by packets carrying an opcode a Router can dispatch
+// on. Opcodes must be comparable.
+type Typed interface {
+    PacketType() any
+}
+
+// PacketType returns the type tag of the message.
+func (m * Message) PacketType() (any) {
+    return m.Type
+}
+
+// MessageFunc handles a packet, as ConnectionHandler.OnMessage does.
+type MessageFunc func(*Connection, Packet) bool
+
+// Router is a ConnectionHandler dispatching packets to the handler
+// registered for their opcode, if they are Typed, or else for their
+// concrete type. Packets matching nothing go to the fallback handler, or to
+// the base handler's OnMessage when no fallback is set. The other callbacks
+// are delegated to the base handler.
+type Router struct {
+    base        ConnectionHandler
+
+    mutex       sync.RWMutex
+    opcodes     map[any]MessageFunc
+    types       map[reflect.Type]MessageFunc
+    fallback    MessageFunc
+}
+
+// NewRouter returns a Router delegating the accept, timeout, close and
+// shutdown callbacks to base, which may be nil.
+func NewRouter(base ConnectionHandler) (*Router) {
+    return &Router{
+        base:       base,
+        opcodes:    make(map[any]MessageFunc),
+        types:      make(map[reflect.Type]MessageFunc),
+    }
+}
+
+// HandleOpcode registers fn for the Typed packets of opcode op.
+func (r * Router) HandleOpcode(op any, fn MessageFunc) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.opcodes[op] = fn
+}
+
+// HandleType registers fn for the packets having the concrete type of
+// sample.
+func (r * Router) HandleType(sample Packet, fn MessageFunc) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.types[reflect.TypeOf(sample)] = fn
+}
+
+// HandleFallback registers fn for the packets no other handler matches.
+func (r * Router) HandleFallback(fn MessageFunc) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.fallback = fn
+}
+
+// Handle registers fn on r for the packets of type P.
+func Handle[P Packet](r *Router, fn func(*Connection, P) bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.types[reflect.TypeFor[P]()] = func(c *Connection, p Packet) bool {
+        return fn(c, p.(P))
+    }
+}
+
+func (r * Router) route(p Packet) (MessageFunc) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    if typed, ok := p.(Typed); ok {
+        if fn, ok := r.opcodes[typed.PacketType()]; ok {
+            return fn
+        }
+    }
+    if fn, ok := r.types[reflect.TypeOf(p)]; ok {
+        return fn
+    }
+    return r.fallback
+}
+
+func (r * Router) OnAccept(c *Connection) (bool) {
+    if r.base != nil {
+        return r.base.OnAccept(c)
+    }
+    return true
+}
+
+func (r * Router) OnMessage(c *Connection, p Packet) (bool) {
+    if fn := r.route(p); fn != nil {
+        return fn(c, p)
+    }
+    if r.base != nil {
+        return r.base.OnMessage(c, p)
+    }
+    return true
+}
+
+func (r * Router) OnTimeout(c *Connection) (bool) {
+    if r.base != nil {
+        return r.base.OnTimeout(c)
+    }
+    return false
+}
+
+func (r * Router) OnClose(c *Connection) {
+    if r.base != nil {
+        r.base.OnClose(c)
+    }
+}
+
+func (r * Router) OnShutdown(c *Connection) {
+    if h, ok := r.base.(ShutdownHandler); ok {
+        h.OnShutdown(c)
+    }
+}
@@ -0,0 +1,100 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "testing"
+)
+
+type OpPacket struct {
+    op byte
+}
+
+func (p * OpPacket) Serialize() []byte {
+    return []byte{p.op}
+}
+
+func (p * OpPacket) PacketType() any {
+    return p.op
+}
+
+type BaseHandler struct {
+    ShutdownAwareHandler
+    messages int
+}
+
+func (h * BaseHandler) OnMessage(c *Connection, p Packet) bool {
+    h.messages++
+    return true
+}
+
+func TestRouter(t *testing.T) {
+    var got []string
+    record := func(name string) MessageFunc {
+        return func(c *Connection, p Packet) bool {
+            got = append(got, name)
+            return true
+        }
+    }
+
+    base := &BaseHandler{}
+    r := NewRouter(base)
+    r.HandleOpcode(byte(1), record("op1"))
+    r.HandleType(&OpPacket{}, record("op-type"))
+    r.HandleOpcode("chat", record("chat"))
+    Handle(r, func(c *Connection, p RawPacket) bool {
+        got = append(got, "raw:" + string(p))
+        return false
+    })
+
+    packets := []Packet{
+        &OpPacket{1},
+        &OpPacket{2},
+        &Message{Type: "chat"},
+        &Message{Type: "join"},
+    }
+    for _, p := range packets {
+        if !r.OnMessage(nil, p) {
+            t.Fatal("unexpected close for ", p)
+        }
+    }
+    if r.OnMessage(nil, RawPacket("x")) {
+        t.Fatal("handler result was not returned")
+    }
+    expect := []string{"op1", "op-type", "chat", "raw:x"}
+    if len(got) != len(expect) {
+        t.Fatal(got)
+    }
+    for i := range expect {
+        if got[i] != expect[i] {
+            t.Fatal(got)
+        }
+    }
+    if base.messages != 1 {
+        t.Fatal("unrouted packet did not reach the base handler")
+    }
+
+    r.HandleFallback(record("fallback"))
+    r.OnMessage(nil, &Message{Type: "join"})
+    if got[len(got) - 1] != "fallback" || base.messages != 1 {
+        t.Fatal("fallback was not used")
+    }
+}
@@ -0,0 +1,335 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "sync/atomic"
+    "encoding/binary"
+)
+
+var(
+    ErrUnknownMethod = errors.New("rpc: unknown method")
+)
+
+const(
+    rpcRequest  byte = iota + 1
+    rpcResponse
+    rpcError
+)
+
+// RPCError is returned by RPC.Call when the remote handler failed. It
+// carries the message of the remote error.
+type RPCError struct {
+    Message     string
+}
+
+func (e * RPCError) Error() (string) {
+    return e.Message
+}
+
+// RPCPacket is the Packet exchanged by an RPCProtocol. Requests carry the
+// method name and the time left to the caller, responses carry the result
+// or the error message in Payload. ID correlates a response with its
+// request.
+type RPCPacket struct {
+    kind        byte
+    ID          uint64
+    Method      string
+    Timeout     time.Duration
+    Payload     []byte
+}
+
+func (p * RPCPacket) IsRequest() (bool) {
+    return p.kind == rpcRequest
+}
+
+func (p * RPCPacket) Serialize() ([]byte) {
+    b := make([]byte, 0, 1 + 3 * binary.MaxVarintLen64 + len(p.Method) + len(p.Payload))
+    b = append(b, p.kind)
+    b = binary.AppendUvarint(b, p.ID)
+    if p.kind == rpcRequest {
+        b = binary.AppendUvarint(b, uint64(len(p.Method)))
+        b = append(b, p.Method...)
+        b = binary.AppendUvarint(b, uint64(p.Timeout / time.Millisecond))
+    }
+    return append(b, p.Payload...)
+}
+
+func decodeRPCPacket(b []byte) (*RPCPacket, error) {
+    if len(b) == 0 || b[0] < rpcRequest || b[0] > rpcError {
+        return nil, ErrMalformedMessage
+    }
+    p := &RPCPacket{kind: b[0]}
+    b = b[1:]
+    var k int
+    if p.ID, k = binary.Uvarint(b); k <= 0 {
+        return nil, ErrMalformedMessage
+    }
+    b = b[k:]
+    if p.kind == rpcRequest {
+        n, k := binary.Uvarint(b)
+        if k <= 0 || uint64(len(b) - k) < n {
+            return nil, ErrMalformedMessage
+        }
+        p.Method = string(b[k:k + int(n)])
+        b = b[k + int(n):]
+        ms, k := binary.Uvarint(b)
+        if k <= 0 {
+            return nil, ErrMalformedMessage
+        }
+        p.Timeout = time.Duration(ms) * time.Millisecond
+        b = b[k:]
+    }
+    p.Payload = b
+    return p, nil
+}
+
+// RPCProtocol carries RPCPackets over a framing protocol.
+type RPCProtocol struct {
+    framing     Protocol
+}
+
+func NewRPCProtocol(framing Protocol) (*RPCProtocol) {
+    return &RPCProtocol{framing: framing}
+}
+
+func (p * RPCProtocol) ReadPacket(c *Connection) (Packet, error) {
+    frame, err := p.framing.ReadPacket(c)
+    if err != nil {
+        return nil, err
+    }
+    return decodeRPCPacket(ownedBytes(frame))
+}
+
+func (p * RPCProtocol) EncodePacket(packet Packet) ([]byte, error) {
+    if enc, ok := p.framing.(PacketEncoder); ok {
+        return enc.EncodePacket(packet)
+    }
+    return packet.Serialize(), nil
+}
+
+// RPCFunc handles a request, payload is the encoded argument and the
+// returned bytes the encoded result.
+type RPCFunc func(ctx context.Context, c *Connection, payload []byte) ([]byte, error)
+
+type rpcCall struct {
+    conn      * Connection
+    done        chan *RPCPacket
+}
+
+// RPC is a ConnectionHandler implementing request/response over an
+// RPCProtocol. Requests are served concurrently by the registered handlers,
+// responses to calls made with Call are routed back to their caller. Every
+// other packet and callback is forwarded to the next handler, if any. The
+// same RPC can serve and issue calls on any number of connections.
+type RPC struct {
+    codec       Codec
+    next        ConnectionHandler
+
+    mutex       sync.Mutex
+    methods     map[string]RPCFunc
+    pending     map[uint64]*rpcCall
+    nextID      atomic.Uint64
+}
+
+// NewRPC returns an RPC encoding arguments and results with codec. next may
+// be nil.
+func NewRPC(codec Codec, next ConnectionHandler) (*RPC) {
+    return &RPC{
+        codec:      codec,
+        next:       next,
+        methods:    make(map[string]RPCFunc),
+        pending:    make(map[uint64]*rpcCall),
+    }
+}
+
+// Handle registers fn as the handler of method.
+func (r * RPC) Handle(method string, fn RPCFunc) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.methods[method] = fn
+}
+
+// HandleRPC registers a typed handler of method on r. The argument is
+// decoded into a new Req and the result encoded with the RPC's codec.
+func HandleRPC[Req, Resp any](r *RPC, method string, fn func(ctx context.Context, c *Connection, req *Req) (Resp, error)) {
+    r.Handle(method, func(ctx context.Context, c *Connection, payload []byte) ([]byte, error) {
+        req := new(Req)
+        if err := r.codec.Unmarshal(payload, req); err != nil {
+            return nil, err
+        }
+        resp, err := fn(ctx, c, req)
+        if err != nil {
+            return nil, err
+        }
+        return r.codec.Marshal(resp)
+    })
+}
+
+// Call invokes method on the peer of c with args and decodes the result into
+// reply, which may be nil to discard it. The deadline of ctx, if any, is
+// transmitted to the peer.
+func (r * RPC) Call(ctx context.Context, c *Connection, method string, args any, reply any) (error) {
+    payload, err := r.codec.Marshal(args)
+    if err != nil {
+        return err
+    }
+    req := &RPCPacket{
+        kind:       rpcRequest,
+        ID:         r.nextID.Add(1),
+        Method:     method,
+        Payload:    payload,
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        if req.Timeout = time.Until(deadline); req.Timeout <= 0 {
+            return context.DeadlineExceeded
+        }
+    }
+
+    call := &rpcCall{conn: c, done: make(chan *RPCPacket, 1)}
+    r.mutex.Lock()
+    r.pending[req.ID] = call
+    r.mutex.Unlock()
+    defer func() {
+        r.mutex.Lock()
+        delete(r.pending, req.ID)
+        r.mutex.Unlock()
+    }()
+
+    if err = c.Send(req); err != nil {
+        return err
+    }
+
+    var resp *RPCPacket
+    select {
+    case resp = <-call.done:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    if resp == nil {
+        return ErrClosed
+    }
+    if resp.kind == rpcError {
+        return &RPCError{Message: string(resp.Payload)}
+    }
+    if reply == nil {
+        return nil
+    }
+    return r.codec.Unmarshal(resp.Payload, reply)
+}
+
+func (r * RPC) OnAccept(c *Connection) (bool) {
+    if r.next != nil {
+        return r.next.OnAccept(c)
+    }
+    return true
+}
+
+func (r * RPC) OnMessage(c *Connection, p Packet) (bool) {
+    packet, ok := p.(*RPCPacket)
+    if !ok {
+        if r.next != nil {
+            return r.next.OnMessage(c, p)
+        }
+        return true
+    }
+    if packet.kind == rpcRequest {
+        go r.serve(c, packet)
+        return true
+    }
+    r.mutex.Lock()
+    call, ok := r.pending[packet.ID]
+    r.mutex.Unlock()
+    if ok && call.conn == c {
+        select {
+        case call.done <- packet:
+        default:
+        }
+    }
+    return true
+}
+
+func (r * RPC) OnTimeout(c *Connection) (bool) {
+    if r.next != nil {
+        return r.next.OnTimeout(c)
+    }
+    return false
+}
+
+func (r * RPC) OnClose(c *Connection) {
+    r.mutex.Lock()
+    for _, call := range r.pending {
+        if call.conn == c {
+            select {
+            case call.done <- nil:
+            default:
+            }
+        }
+    }
+    r.mutex.Unlock()
+    if r.next != nil {
+        r.next.OnClose(c)
+    }
+}
+
+func (r * RPC) OnShutdown(c *Connection) {
+    if h, ok := r.next.(ShutdownHandler); ok {
+        h.OnShutdown(c)
+    }
+}
+
+func (r * RPC) serve(c *Connection, req *RPCPacket) {
+    ctx := c.Context()
+    if req.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+        defer cancel()
+    }
+
+    resp := &RPCPacket{kind: rpcResponse, ID: req.ID}
+    payload, err := r.call(ctx, c, req)
+    if err != nil {
+        resp.kind = rpcError
+        payload = []byte(err.Error())
+    }
+    resp.Payload = payload
+    c.Send(resp)
+}
+
+func (r * RPC) call(ctx context.Context, c *Connection, req *RPCPacket) (payload []byte, err error) {
+    r.mutex.Lock()
+    fn, ok := r.methods[req.Method]
+    r.mutex.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("%w %q", ErrUnknownMethod, req.Method)
+    }
+    defer func() {
+        if v := recover(); v != nil {
+            err = fmt.Errorf("rpc: %s: panic: %v", req.Method, v)
+        }
+    }()
+    return fn(ctx, c, req.Payload)
+}
@@ -0,0 +1,155 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "time"
+    "errors"
+    "context"
+    "testing"
+)
+
+type AddArgs struct {
+    A, B int
+}
+
+func rpcRoundTrip(t *testing.T, conn net.Conn, c *Connection, p *RPCProtocol, req *RPCPacket) (*RPCPacket) {
+    b, _ := p.EncodePacket(req)
+    conn.Write(b)
+    packet, err := p.ReadPacket(c)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return packet.(*RPCPacket)
+}
+
+func TestRPCServe(t *testing.T) {
+    p := NewRPCProtocol(NewVarintProtocol(0))
+    r := NewRPC(JSONCodec{}, nil)
+    HandleRPC(r, "add", func(ctx context.Context, c *Connection, args *AddArgs) (int, error) {
+        return args.A + args.B, nil
+    })
+    HandleRPC(r, "fail", func(ctx context.Context, c *Connection, args *AddArgs) (int, error) {
+        return 0, errors.New("boom")
+    })
+    HandleRPC(r, "wait", func(ctx context.Context, c *Connection, args *AddArgs) (bool, error) {
+        <-ctx.Done()
+        return true, ctx.Err()
+    })
+
+    s := NewServer("127.0.0.1:0", r, p)
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(time.Second))
+    c := NewConnection(nil, conn)
+
+    resp := rpcRoundTrip(t, conn, c, p, &RPCPacket{kind: rpcRequest, ID: 7, Method: "add", Payload: []byte(`{"A":2,"B":3}`)})
+    if resp.ID != 7 || resp.kind != rpcResponse || string(resp.Payload) != "5" {
+        t.Fatalf("%+v", resp)
+    }
+    resp = rpcRoundTrip(t, conn, c, p, &RPCPacket{kind: rpcRequest, ID: 8, Method: "fail", Payload: []byte(`{}`)})
+    if resp.ID != 8 || resp.kind != rpcError || string(resp.Payload) != "boom" {
+        t.Fatalf("%+v", resp)
+    }
+    resp = rpcRoundTrip(t, conn, c, p, &RPCPacket{kind: rpcRequest, ID: 9, Method: "nope", Payload: []byte(`{}`)})
+    if resp.kind != rpcError {
+        t.Fatalf("%+v", resp)
+    }
+    resp = rpcRoundTrip(t, conn, c, p, &RPCPacket{kind: rpcRequest, ID: 10, Method: "wait", Timeout: 20 * time.Millisecond, Payload: []byte(`{}`)})
+    if resp.kind != rpcError || string(resp.Payload) != context.DeadlineExceeded.Error() {
+        t.Fatalf("%+v", resp)
+    }
+}
+
+type RPCCallHandler struct {
+    ShutdownAwareHandler
+    accepted chan *Connection
+}
+
+func (h * RPCCallHandler) OnAccept(c *Connection) bool {
+    h.accepted <- c
+    return true
+}
+
+func TestRPCCall(t *testing.T) {
+    p := NewRPCProtocol(NewVarintProtocol(0))
+    h := &RPCCallHandler{accepted: make(chan *Connection, 1)}
+    r := NewRPC(JSONCodec{}, h)
+    s := NewServer("127.0.0.1:0", r, p)
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    peer := NewConnection(nil, conn)
+    sc := <-h.accepted
+
+    go func() {
+        packet, err := p.ReadPacket(peer)
+        if err != nil {
+            return
+        }
+        req := packet.(*RPCPacket)
+        if req.Method != "echo" || req.Timeout <= 0 {
+            return
+        }
+        b, _ := p.EncodePacket(&RPCPacket{kind: rpcResponse, ID: req.ID, Payload: req.Payload})
+        conn.Write(b)
+
+        packet, err = p.ReadPacket(peer)
+        if err != nil {
+            return
+        }
+        b, _ = p.EncodePacket(&RPCPacket{kind: rpcError, ID: packet.(*RPCPacket).ID, Payload: []byte("denied")})
+        conn.Write(b)
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    var reply string
+    if err = r.Call(ctx, sc, "echo", "hello", &reply); err != nil {
+        t.Fatal(err)
+    }
+    if reply != "hello" {
+        t.Fatal(reply, " != hello")
+    }
+
+    var rerr *RPCError
+    if err = r.Call(ctx, sc, "other", nil, nil); !errors.As(err, &rerr) || rerr.Message != "denied" {
+        t.Fatal(err)
+    }
+
+    short, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+    defer cancel()
+    if err = r.Call(short, sc, "unanswered", nil, nil); err != context.DeadlineExceeded {
+        t.Fatal(err)
+    }
+}
@@ -22,8 +22,18 @@ package server
 
 import(
     "net"
+    "net/netip"
+    "os"
+    "fmt"
+    "context"
     "crypto/tls"
+    "crypto/x509"
     "sync"
+    "sync/atomic"
+    "time"
+    "slices"
+    "cmp"
+    "github.com/kdruelle/gutils/trace"
     "github.com/kdruelle/gutils/workerpool"
 )
 
@@ -34,90 +44,335 @@ type Server struct {
     protocol        Protocol
     
     ssl             bool
-    sslCert         string
-    sslKey          string
+    certFiles       []keyPairFile
+    certStore     * CertStore
+    certReload      bool
+    certInterval    time.Duration
+    clientCAs     * x509.CertPool
+    tlsConfig     * tls.Config
 
-    listener      net.Listener
-    stop          bool
+    workers         int
+    queueLength     int
+    limiter         limiter
+    metrics         serverMetrics
+    tracer          trace.Tracer
+    accessList     *AccessList
+    onAccessDenied  func(net.Addr)
+    proxyMode       ProxyProtocolMode
+    unixSocket      bool
+    socketPerm      os.FileMode
+    datagram        bool
+    extraListeners  []*Listener
+    mux           * Mux
+    connOptions
+
+    listeners       []*Listener
+    packetConn      net.PacketConn
+    sessions        map[string]*Connection
+    stop          atomic.Bool
+    done          chan struct{}
+    doneOnce      sync.Once
     pool        * workerpool.WorkerPool
-    
-    laddr       * net.TCPAddr
+    poolStop      sync.Once
 
+    mutex         sync.Mutex
+    connections   map[uint64]*Connection
+    nextID        atomic.Uint64
     waitGroup   *sync.WaitGroup
 }
 
-func NewServer(localAddr string, handler ConnectionHandler, protocol Protocol) (*Server){
+// ShutdownHandler can be implemented by a ConnectionHandler that wants to be
+// notified when the server starts shutting down, typically to tell the peer
+// to go away and close the connection on its own terms.
+type ShutdownHandler interface {
+    OnShutdown(*Connection)
+}
+
+// ShutdownError is returned by Shutdown when the context expired before all
+// the connections were drained. Killed is the number of connections that
+// had to be force-closed.
+type ShutdownError struct {
+    Killed      int
+    Err         error
+}
+
+func (e * ShutdownError) Error() (string) {
+    return fmt.Sprintf("server: shutdown forced, %d connection(s) killed: %v", e.Killed, e.Err)
+}
+
+func (e * ShutdownError) Unwrap() (error) {
+    return e.Err
+}
+
+func NewServer(localAddr string, handler ConnectionHandler, protocol Protocol, opts ...Option) (*Server){
     server := &Server{
         localAddr  : localAddr,
         handler    : handler,
         protocol   : protocol,
-        stop       : false,
-        pool       : workerpool.NewWorkerPool(5, 100),
+        workers    : 5,
+        queueLength: 100,
         ssl        : false,
+        done       : make(chan struct{}),
+        connections: make(map[uint64]*Connection),
+        sessions   : make(map[string]*Connection),
         waitGroup  : &sync.WaitGroup{},
+        tracer     : trace.Nop(),
+    }
+    server.handshakeTimeout = 10 * time.Second
+    for _, opt := range opts {
+        opt(server)
     }
+    server.limiter.init()
+    server.pool = workerpool.NewWorkerPool(server.workers, server.queueLength)
+    server.pool.SetTracer(server.tracer)
     server.pool.Run()
     return server
 }
 
+// Start listens on the local address of the server, a unix socket path if
+// WithUnixSocket was given, and on the listeners added with WithListener,
+// then serves until the server is stopped. The local address may be empty if
+// there are other listeners. With WithDatagram, it listens for UDP or unix
+// datagrams and serves them with ServePacket.
 func (s * Server) Start() (err error){
-    s.laddr, err = net.ResolveTCPAddr("tcp", s.localAddr)
-    if err != nil {
-        return
+    if s.datagram {
+        pc, err := s.listenPacket()
+        if err != nil {
+            return err
+        }
+        return s.ServePacket(pc)
     }
-    if s.ssl {
-        err = s.ListenAndServeTLS()
-    } else {
-        err = s.listenAndServe()
+    listeners := s.extraListeners
+    if s.localAddr != "" || len(listeners) == 0 {
+        listeners = append([]*Listener{s.defaultListener()}, listeners...)
     }
-    return
+    nls := make([]net.Listener, 0, len(listeners))
+    for _, l := range listeners {
+        nl, err := l.listen()
+        if err != nil {
+            for _, nl := range nls {
+                nl.Close()
+            }
+            return err
+        }
+        nls = append(nls, nl)
+    }
+    return s.serveListeners(listeners, nls)
+}
+
+// Serve accepts connections on l until the server is stopped, then closes
+// l. Any listener may be used, such as one inherited through systemd socket
+// activation. If the server is configured for TLS, l is wrapped to perform
+// the handshake. Serve returns nil once the server is stopped, or the error
+// that made l unusable.
+func (s * Server) Serve(l net.Listener) (error) {
+    return s.serveListeners([]*Listener{s.defaultListener()}, []net.Listener{l})
 }
 
+// Stop stops the server and waits, without any deadline, for every
+// connection to terminate.
 func (s * Server) Stop(){
-    s.stop = true
-    s.listener.Close()
-    s.pool.Stop()
-    s.waitGroup.Wait()
+    s.Shutdown(context.Background())
 }
 
-func (s * Server) listenAndServe() (err error){
-    s.listener, err = net.ListenTCP("tcp", s.laddr)
-    if err != nil {
-        return
+// Shutdown gracefully stops the server: the listeners are closed, every
+// accepted connection is notified through its handler's OnShutdown hook if
+// it has one, connections still waiting for a worker are closed, then
+// Shutdown waits for the connections to terminate. If ctx expires first, the
+// remaining connections are force-closed and a *ShutdownError reporting how
+// many were killed is returned.
+func (s * Server) Shutdown(ctx context.Context) (err error) {
+    s.mutex.Lock()
+    s.stop.Store(true)
+    listeners := s.listeners
+    packetConn := s.packetConn
+    conns := s.liveConnections()
+    s.mutex.Unlock()
+    s.doneOnce.Do(func() {
+        close(s.done)
+    })
+
+    for _, l := range listeners {
+        l.listener.Close()
+    }
+    if packetConn != nil {
+        packetConn.Close()
+    }
+    for _, c := range conns {
+        if c.accepted.Load() {
+            c.notifyShutdown()
+        }
+    }
+
+    done := make(chan struct{})
+    go func() {
+        s.waitGroup.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-ctx.Done():
+        s.mutex.Lock()
+        conns = s.liveConnections()
+        s.mutex.Unlock()
+        for _, c := range conns {
+            c.closeWith(CloseShutdown, ErrShutdown)
+        }
+        <-done
+        err = &ShutdownError{Killed: len(conns), Err: ctx.Err()}
     }
-    s.serve()
+
+    s.poolStop.Do(s.pool.Stop)
     return
 }
 
-func (s * Server) ListenAndServeTLS() (err error) {
-    cer, err := tls.LoadX509KeyPair(s.sslCert, s.sslKey)
-    if err != nil {
-        return
+// Addr returns the address the server is listening on, the one of its first
+// listener if it has several, or nil if it is not listening yet.
+func (s * Server) Addr() (net.Addr) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if s.packetConn != nil {
+        return s.packetConn.LocalAddr()
     }
-    config := &tls.Config{
-        Certificates  : []tls.Certificate{cer},
-        MinVersion    : tls.VersionSSL30,
+    if len(s.listeners) == 0 {
+        return nil
     }
+    return s.listeners[0].Addr()
+}
+
+// Listeners returns the listeners the server is serving.
+func (s * Server) Listeners() ([]*Listener) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return slices.Clone(s.listeners)
+}
 
-    s.listener, err = tls.Listen("tcp", s.laddr.String(), config)
-    if err != nil {
-        return
+// Connections returns the accepted connections currently held by the
+// server, ordered by ID.
+func (s * Server) Connections() (conns []*Connection) {
+    s.mutex.Lock()
+    for _, c := range s.connections {
+        if c.accepted.Load() {
+            conns = append(conns, c)
+        }
     }
-    s.serve()
+    s.mutex.Unlock()
+    slices.SortFunc(conns, func(a, b *Connection) int {
+        return cmp.Compare(a.id, b.id)
+    })
     return
 }
 
-func (s * Server) serve() {
-    for {
-        conn, err := s.listener.Accept()
-        if err != nil {
-            if s.stop {
-                return
+// Get returns the accepted connection identified by id.
+func (s * Server) Get(id uint64) (*Connection, bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    c, ok := s.connections[id]
+    if !ok || !c.accepted.Load() {
+        return nil, false
+    }
+    return c, true
+}
+
+// Broadcast sends p to every accepted connection and returns the number of
+// connections it was successfully sent to.
+func (s * Server) Broadcast(p Packet) (int) {
+    return s.BroadcastFunc(nil, p)
+}
+
+// BroadcastFunc sends p to every accepted connection for which filter
+// returns true. A nil filter matches every connection. The packet is encoded
+// once for the connections using the protocol of the server, and by each
+// connection on listeners with a protocol of their own.
+func (s * Server) BroadcastFunc(filter func(*Connection) bool, p Packet) (n int) {
+    b, err := encodePacket(s.protocol, p)
+    for _, c := range s.Connections() {
+        if filter != nil && !filter(c) {
+            continue
+        }
+        if c.protocol != s.protocol {
+            if c.Send(p) == nil {
+                n++
             }
             continue
         }
-        c := NewConnection(s, conn)
-        s.pool.Handle(c)
+        if err == nil && c.send(b) == nil {
+            n++
+        }
+    }
+    return
+}
+
+func (s * Server) connectionCount() (int) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return len(s.connections)
+}
+
+func (s * Server) liveConnections() (conns []*Connection) {
+    for _, c := range s.connections {
+        conns = append(conns, c)
     }
+    return
+}
+
+// track registers c, applying the connection count limits atomically. It
+// returns ErrShutdown if the server is stopping and ErrRejected if a limit
+// was reached.
+func (s * Server) track(c * Connection) (error) {
+    addr := c.conn.RemoteAddr()
+    var ip netip.Addr
+    if !c.proxied() {
+        ip, _ = remoteIP(addr)
+    }
+    s.mutex.Lock()
+    if s.stop.Load() {
+        s.mutex.Unlock()
+        return ErrShutdown
+    }
+    max := s.limiter.MaxConnections
+    if max == 0 && c.datagram {
+        max = DefaultMaxSessions
+    }
+    if max > 0 && len(s.connections) >= max {
+        s.mutex.Unlock()
+        s.limiter.fire(LimitConnections, addr, nil)
+        return ErrRejected
+    }
+    if !s.limiter.open(ip) {
+        s.mutex.Unlock()
+        s.limiter.fire(LimitConnectionsPerIP, addr, nil)
+        return ErrRejected
+    }
+    c.remoteIP = ip
+    c.id = s.nextID.Add(1)
+    s.connections[c.id] = c
+    s.metrics.accepted.Add(1)
+    s.waitGroup.Add(1)
+    if s.limiter.MessageRate > 0 {
+        c.messages = newTokenBucket(s.limiter.MessageRate, s.limiter.MessageBurst)
+    }
+    s.mutex.Unlock()
+    return nil
+}
+
+func (s * Server) untrack(c * Connection) {
+    s.mutex.Lock()
+    delete(s.connections, c.id)
+    if c.datagram {
+        addr := c.conn.RemoteAddr()
+        delete(s.sessions, addr.Network() + ":" + addr.String())
+    }
+    s.mutex.Unlock()
+    s.limiter.closed(c.remoteIP)
+    s.waitGroup.Done()
 }
 
+// ListenAndServeTLS is Start for a server that must use TLS.
+func (s * Server) ListenAndServeTLS() (err error) {
+    s.ssl = true
+    return s.Start()
+}
+
+
@@ -0,0 +1,119 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import(
+    "net"
+    "errors"
+    "context"
+    "testing"
+    "time"
+)
+
+type ShutdownAwareHandler struct {
+    Handler
+}
+
+func (h * ShutdownAwareHandler) OnAccept(c *Connection) bool {
+    return true
+}
+
+func (h * ShutdownAwareHandler) OnShutdown(c *Connection) {
+    c.Close()
+}
+
+func startServer(t *testing.T, s *Server) (net.Addr) {
+    go s.Start()
+    for i := 0; i < 100; i++ {
+        if addr := s.Addr(); addr != nil {
+            return addr
+        }
+        time.Sleep(time.Millisecond * 10)
+    }
+    t.Fatal("server did not start")
+    return nil
+}
+
+func dialServer(t *testing.T, addr net.Addr) (net.Conn) {
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.Write([]byte("ping\r\n"))
+    b := make([]byte, 6)
+    if _, err = conn.Read(b); err != nil {
+        t.Fatal(err)
+    }
+    return conn
+}
+
+func TestShutdownDrain(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{})
+    conn := dialServer(t, startServer(t, s))
+    defer conn.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := s.Shutdown(ctx); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestShutdownQueuedConnections(t *testing.T) {
+    s := NewServer("127.0.0.1:0", &ShutdownAwareHandler{}, &TelnetProtocol{}, WithWorkers(1))
+    addr := startServer(t, s)
+    first := dialServer(t, addr)
+    defer first.Close()
+    // The only worker serves first, so second waits in the pool queue.
+    second, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer second.Close()
+    time.Sleep(time.Millisecond * 50)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
+    defer cancel()
+    if err := s.Shutdown(ctx); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestShutdownForce(t *testing.T) {
+    h := &Handler{t}
+    s := NewServer("127.0.0.1:0", h, &TelnetProtocol{})
+    conn := dialServer(t, startServer(t, s))
+    defer conn.Close()
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    err := s.Shutdown(ctx)
+
+    var serr *ShutdownError
+    if !errors.As(err, &serr) {
+        t.Fatal("expected a ShutdownError, got ", err)
+    }
+    if serr.Killed != 1 {
+        t.Fatal(serr.Killed, " != 1")
+    }
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,83 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "io"
+    "net"
+    "time"
+    "testing"
+)
+
+type TimeoutHandler struct {
+    EchoHandler
+    kinds chan TimeoutKind
+}
+
+func (h * TimeoutHandler) OnTimeout(c *Connection) bool {
+    h.kinds <- c.TimeoutKind()
+    return false
+}
+
+func TestServerTimeouts(t *testing.T) {
+    h := &TimeoutHandler{kinds: make(chan TimeoutKind, 4)}
+    s := NewServer("127.0.0.1:0", h, NewLineProtocol(0),
+        WithIdleTimeout(time.Millisecond * 60), WithReadTimeout(time.Millisecond * 30))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    b := make([]byte, 5)
+    for i := 0; i < 5; i++ {
+        conn.Write([]byte("ping\n"))
+        if _, err = io.ReadFull(conn, b); err != nil {
+            t.Fatal("active connection timed out: ", err)
+        }
+        time.Sleep(time.Millisecond * 30)
+    }
+    select {
+    case kind := <-h.kinds:
+        if kind != TimeoutIdle {
+            t.Fatal(kind, " != ", TimeoutIdle)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("idle timeout did not fire")
+    }
+
+    conn, err = net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.Write([]byte("partial"))
+    select {
+    case kind := <-h.kinds:
+        if kind != TimeoutRead {
+            t.Fatal(kind, " != ", TimeoutRead)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("read timeout did not fire")
+    }
+}
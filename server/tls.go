@@ -0,0 +1,229 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "sync"
+    "time"
+    "strings"
+    "syscall"
+    "os/signal"
+    "crypto/tls"
+    "crypto/x509"
+)
+
+type keyPairFile struct {
+    cert        string
+    key         string
+    modTime     time.Time
+}
+
+// CertStore holds key pairs loaded from disk and selects the one presented
+// to a client from the server name it asked for (SNI). It can be reloaded
+// at any time without disturbing the listener.
+type CertStore struct {
+    mutex       sync.RWMutex
+    files       []keyPairFile
+    certs       []*tls.Certificate
+    names       map[string]*tls.Certificate
+}
+
+func NewCertStore() (*CertStore) {
+    return &CertStore{
+        names: make(map[string]*tls.Certificate),
+    }
+}
+
+// Add loads the key pair from certFile and keyFile and adds it to the store.
+func (cs * CertStore) Add(certFile, keyFile string) (error) {
+    cs.mutex.Lock()
+    defer cs.mutex.Unlock()
+    files := append(cs.files, newKeyPairFile(certFile, keyFile))
+    return cs.load(files)
+}
+
+// Reload loads every key pair of the store again. On error, the previously
+// loaded certificates are kept.
+func (cs * CertStore) Reload() (error) {
+    cs.mutex.Lock()
+    defer cs.mutex.Unlock()
+    files := make([]keyPairFile, len(cs.files))
+    for i, f := range cs.files {
+        files[i] = newKeyPairFile(f.cert, f.key)
+    }
+    return cs.load(files)
+}
+
+// GetCertificate is suitable for tls.Config.GetCertificate. It returns the
+// certificate matching the requested server name, or the first certificate
+// of the store when nothing matches.
+func (cs * CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    cs.mutex.RLock()
+    defer cs.mutex.RUnlock()
+    if len(cs.certs) == 0 {
+        return nil, nil
+    }
+    name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+    if cert, ok := cs.names[name]; ok {
+        return cert, nil
+    }
+    if i := strings.IndexByte(name, '.'); i > 0 {
+        if cert, ok := cs.names["*" + name[i:]]; ok {
+            return cert, nil
+        }
+    }
+    return cs.certs[0], nil
+}
+
+// Watch reloads the store when one of its files changes, checking every
+// interval, and when the process receives SIGHUP, until stop is closed.
+func (cs * CertStore) Watch(interval time.Duration, stop <-chan struct{}) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    defer signal.Stop(hup)
+
+    var tick <-chan time.Time
+    if interval > 0 {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-hup:
+            cs.Reload()
+        case <-tick:
+            if cs.changed() {
+                cs.Reload()
+            }
+        }
+    }
+}
+
+func (cs * CertStore) changed() (bool) {
+    cs.mutex.RLock()
+    defer cs.mutex.RUnlock()
+    for _, f := range cs.files {
+        n := newKeyPairFile(f.cert, f.key)
+        if !n.modTime.Equal(f.modTime) {
+            return true
+        }
+    }
+    return false
+}
+
+func (cs * CertStore) load(files []keyPairFile) (error) {
+    certs := make([]*tls.Certificate, 0, len(files))
+    names := make(map[string]*tls.Certificate)
+    for _, f := range files {
+        cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+        if err != nil {
+            return err
+        }
+        if cert.Leaf == nil {
+            cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+            if err != nil {
+                return err
+            }
+        }
+        certs = append(certs, &cert)
+        for _, name := range certNames(cert.Leaf) {
+            if _, ok := names[name]; !ok {
+                names[name] = &cert
+            }
+        }
+    }
+    cs.files = files
+    cs.certs = certs
+    cs.names = names
+    return nil
+}
+
+func newKeyPairFile(cert, key string) (f keyPairFile) {
+    f.cert = cert
+    f.key = key
+    for _, name := range []string{cert, key} {
+        if fi, err := os.Stat(name); err == nil && fi.ModTime().After(f.modTime) {
+            f.modTime = fi.ModTime()
+        }
+    }
+    return
+}
+
+func certNames(leaf *x509.Certificate) (names []string) {
+    for _, name := range leaf.DNSNames {
+        names = append(names, strings.ToLower(name))
+    }
+    if len(names) == 0 && leaf.Subject.CommonName != "" {
+        names = append(names, strings.ToLower(leaf.Subject.CommonName))
+    }
+    return
+}
+
+// ReloadCertificates reloads the certificate files given with
+// WithCertFiles. It has no effect before the server is listening.
+func (s * Server) ReloadCertificates() (error) {
+    s.mutex.Lock()
+    store := s.certStore
+    s.mutex.Unlock()
+    if store == nil {
+        return nil
+    }
+    return store.Reload()
+}
+
+func (s * Server) buildTLSConfig() (*tls.Config, error) {
+    config := &tls.Config{}
+    if s.tlsConfig != nil {
+        config = s.tlsConfig.Clone()
+    }
+    if config.MinVersion == 0 {
+        config.MinVersion = tls.VersionTLS12
+    }
+    if s.clientCAs != nil {
+        config.ClientCAs = s.clientCAs
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    if len(s.certFiles) == 0 {
+        return config, nil
+    }
+
+    store := NewCertStore()
+    for _, f := range s.certFiles {
+        if err := store.Add(f.cert, f.key); err != nil {
+            return nil, err
+        }
+    }
+    if config.GetCertificate == nil {
+        config.GetCertificate = store.GetCertificate
+    }
+    s.mutex.Lock()
+    s.certStore = store
+    s.mutex.Unlock()
+    if s.certReload {
+        go store.Watch(s.certInterval, s.done)
+    }
+    return config, nil
+}
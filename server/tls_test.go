@@ -0,0 +1,202 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "time"
+    "testing"
+    "math/big"
+    "path/filepath"
+    "encoding/pem"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/rand"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/x509/pkix"
+)
+
+type testCA struct {
+    cert    *x509.Certificate
+    key     *ecdsa.PrivateKey
+    serial  int64
+}
+
+func newTestCA(t *testing.T) (*testCA) {
+    ca := &testCA{}
+    ca.cert, ca.key, _ = ca.issue(t, "test ca", nil, true)
+    return ca
+}
+
+func (ca *testCA) issue(t *testing.T, name string, dnsNames []string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ca.serial++
+    tmpl := &x509.Certificate{
+        SerialNumber:          big.NewInt(ca.serial),
+        Subject:               pkix.Name{CommonName: name},
+        DNSNames:              dnsNames,
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  isCA,
+    }
+    parent, signer := tmpl, key
+    if ca.cert != nil {
+        parent, signer = ca.cert, ca.key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cert, key, der
+}
+
+func (ca *testCA) writeKeyPair(t *testing.T, dir, name string, dnsNames ...string) (certFile, keyFile string) {
+    _, key, der := ca.issue(t, name, dnsNames, false)
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certFile = filepath.Join(dir, name + ".crt")
+    keyFile = filepath.Join(dir, name + ".key")
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return
+}
+
+func (ca *testCA) clientCertificate(t *testing.T, name string) (tls.Certificate) {
+    _, key, der := ca.issue(t, name, nil, false)
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) pool() (*x509.CertPool) {
+    pool := x509.NewCertPool()
+    pool.AddCert(ca.cert)
+    return pool
+}
+
+func TestCertStoreSNIAndReload(t *testing.T) {
+    ca := newTestCA(t)
+    dir := t.TempDir()
+    aCert, aKey := ca.writeKeyPair(t, dir, "a", "a.example")
+    bCert, bKey := ca.writeKeyPair(t, dir, "b", "*.b.example")
+
+    store := NewCertStore()
+    if err := store.Add(aCert, aKey); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Add(bCert, bKey); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := map[string]string{
+        "a.example":     "a",
+        "www.b.example": "b",
+        "unknown":       "a",
+    }
+    for sni, expect := range tests {
+        cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if cert.Leaf.Subject.CommonName != expect {
+            t.Fatal(sni, ": ", cert.Leaf.Subject.CommonName, " != ", expect)
+        }
+    }
+
+    before, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example"})
+    ca.writeKeyPair(t, dir, "a", "a.example")
+    if !store.changed() {
+        future := time.Now().Add(time.Minute)
+        os.Chtimes(aCert, future, future)
+    }
+    if !store.changed() {
+        t.Fatal("rewritten certificate was not detected")
+    }
+    if err := store.Reload(); err != nil {
+        t.Fatal(err)
+    }
+    after, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example"})
+    if before.Leaf.SerialNumber.Cmp(after.Leaf.SerialNumber) == 0 {
+        t.Fatal("certificate was not reloaded")
+    }
+}
+
+type PeerHandler struct {
+    ShutdownAwareHandler
+    peer chan string
+}
+
+func (h * PeerHandler) OnAccept(c *Connection) bool {
+    if certs := c.PeerCertificates(); len(certs) > 0 {
+        h.peer <- certs[0].Subject.CommonName
+    }
+    return true
+}
+
+func TestMutualTLS(t *testing.T) {
+    ca := newTestCA(t)
+    certFile, keyFile := ca.writeKeyPair(t, t.TempDir(), "server", "localhost")
+
+    h := &PeerHandler{peer: make(chan string, 1)}
+    s := NewServer("127.0.0.1:0", h, &TelnetProtocol{},
+        WithCertFiles(certFile, keyFile), WithClientCAs(ca.pool()))
+    addr := startServer(t, s)
+    defer s.Stop()
+
+    config := &tls.Config{
+        ServerName:   "localhost",
+        RootCAs:      ca.pool(),
+        MinVersion:   tls.VersionTLS10,
+        MaxVersion:   tls.VersionTLS11,
+    }
+    if conn, err := tls.Dial("tcp", addr.String(), config); err == nil {
+        conn.Close()
+        t.Fatal("TLS 1.1 handshake succeeded")
+    }
+
+    config.MaxVersion = 0
+    config.Certificates = []tls.Certificate{ca.clientCertificate(t, "client")}
+    conn, err := tls.Dial("tcp", addr.String(), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    select {
+    case name := <-h.peer:
+        if name != "client" {
+            t.Fatal(name, " != client")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("peer certificate was not exposed")
+    }
+}
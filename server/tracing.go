@@ -0,0 +1,69 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "context"
+    "github.com/kdruelle/gutils/trace"
+)
+
+// startAccept starts the span of the admission of a connection from addr.
+// The span of the connection's job in the worker pool is its child.
+func (s * Server) startAccept(addr net.Addr, l *Listener) (context.Context, trace.Span) {
+    var name string
+    if l != nil {
+        name = l.name
+    }
+    return s.tracer.Start(context.Background(), "server.accept",
+        trace.Attr("net.transport", addr.Network()),
+        trace.Attr("net.peer.address", addr.String()),
+        trace.Attr("server.listener", name))
+}
+
+// DoContext serves the connection as Do does, ctx being the parent of the
+// spans of its packets. The worker pool calls it with the span of the job.
+func (c * Connection) DoContext(ctx context.Context) {
+    c.traceCtx = ctx
+    c.Do()
+}
+
+// tracing reports whether the spans of the connection are recorded. The
+// attributes of the spans started for each packet are only built if so.
+func (c * Connection) tracing() (bool) {
+    return c.server != nil && !trace.IsNop(c.server.tracer)
+}
+
+// startSpan starts a span about the connection, child of the span of its
+// job.
+func (c * Connection) startSpan(name string, attrs ...trace.Attribute) (trace.Span) {
+    if !c.tracing() {
+        _, span := trace.Nop().Start(c.ctx, name)
+        return span
+    }
+    tracer := c.server.tracer
+    parent := c.traceCtx
+    if parent == nil {
+        parent = c.ctx
+    }
+    _, span := tracer.Start(parent, name, append(attrs, trace.Attr("server.connection.id", c.id))...)
+    return span
+}
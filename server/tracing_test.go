@@ -0,0 +1,130 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "net"
+    "sync"
+    "time"
+    "bufio"
+    "context"
+    "testing"
+    "github.com/kdruelle/gutils/trace"
+)
+
+type spanKey struct {}
+
+type recordedSpan struct {
+    name    string
+    parent  string
+    attrs   map[string]any
+    ended   bool
+}
+
+type recordingTracer struct {
+    mutex   sync.Mutex
+    spans   []*recordedSpan
+}
+
+func (t * recordingTracer) Start(ctx context.Context, name string, attrs ...trace.Attribute) (context.Context, trace.Span) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    s := &recordedSpan{name: name, attrs: map[string]any{}}
+    if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+        s.parent = parent.name
+    }
+    for _, a := range attrs {
+        s.attrs[a.Key] = a.Value
+    }
+    t.spans = append(t.spans, s)
+    return context.WithValue(ctx, spanKey{}, s), &recordingSpan{t, s}
+}
+
+func (t * recordingTracer) find(name string) (*recordedSpan) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    for _, s := range t.spans {
+        if s.name == name && s.ended {
+            return s
+        }
+    }
+    return nil
+}
+
+type recordingSpan struct {
+    tracer  *recordingTracer
+    span    *recordedSpan
+}
+
+func (s * recordingSpan) SetAttributes(attrs ...trace.Attribute) {
+    s.tracer.mutex.Lock()
+    defer s.tracer.mutex.Unlock()
+    for _, a := range attrs {
+        s.span.attrs[a.Key] = a.Value
+    }
+}
+
+func (s * recordingSpan) End(err error) {
+    s.tracer.mutex.Lock()
+    defer s.tracer.mutex.Unlock()
+    s.span.ended = true
+}
+
+func TestTracing(t *testing.T) {
+    tracer := &recordingTracer{}
+    s := NewServer("127.0.0.1:0", &EchoHandler{}, NewLineProtocol(64), WithTracer(tracer))
+    addr := startServer(t, s)
+
+    conn, err := net.Dial("tcp", addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.Write([]byte("hello\n"))
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+        t.Fatal(err)
+    }
+    conn.Close()
+    s.Stop()
+
+    tests := []struct{
+        name    string
+        parent  string
+        attr    string
+    }{
+        {"server.accept",       "",                 "net.peer.address"},
+        {"workerpool.job",      "server.accept",    "workerpool.worker"},
+        {"server.read_packet",  "workerpool.job",   "server.packet.type"},
+        {"server.on_message",   "workerpool.job",   "server.connection.id"},
+    }
+    for _, tt := range tests {
+        span := tracer.find(tt.name)
+        if span == nil {
+            t.Fatal("no ended ", tt.name, " span")
+        }
+        if span.parent != tt.parent {
+            t.Fatal(tt.name, " parent is ", span.parent)
+        }
+        if _, ok := span.attrs[tt.attr]; !ok {
+            t.Fatal(tt.name, " has no ", tt.attr, " attribute")
+        }
+    }
+}
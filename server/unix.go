@@ -0,0 +1,102 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "net"
+    "time"
+    "errors"
+    "io/fs"
+    "strings"
+)
+
+var(
+    ErrSocketInUse = errors.New("unix socket is in use")
+)
+
+// listenUnix listens on the unix socket path, removing a stale socket file
+// first and applying perm to the new one.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+    if err := removeStaleSocket("unix", path); err != nil {
+        return nil, err
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := chmodSocket(path, perm); err != nil {
+        l.Close()
+        return nil, err
+    }
+    return l, nil
+}
+
+// listenUnixgram is listenUnix for datagram sockets.
+func listenUnixgram(path string, perm os.FileMode) (net.PacketConn, error) {
+    if err := removeStaleSocket("unixgram", path); err != nil {
+        return nil, err
+    }
+    pc, err := net.ListenPacket("unixgram", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := chmodSocket(path, perm); err != nil {
+        pc.Close()
+        return nil, err
+    }
+    return pc, nil
+}
+
+func isAbstractSocket(path string) (bool) {
+    return strings.HasPrefix(path, "@")
+}
+
+func chmodSocket(path string, perm os.FileMode) (error) {
+    if perm == 0 || isAbstractSocket(path) {
+        return nil
+    }
+    return os.Chmod(path, perm)
+}
+
+// removeStaleSocket removes the socket file at path if no process accepts
+// connections on it anymore. Files that are not sockets are left alone.
+func removeStaleSocket(network, path string) (error) {
+    if isAbstractSocket(path) {
+        return nil
+    }
+    fi, err := os.Lstat(path)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if fi.Mode() & fs.ModeSocket == 0 {
+        return &os.PathError{Op: "listen", Path: path, Err: errors.New("file exists and is not a socket")}
+    }
+    conn, err := net.DialTimeout(network, path, time.Second)
+    if err == nil {
+        conn.Close()
+        return &os.PathError{Op: "listen", Path: path, Err: ErrSocketInUse}
+    }
+    return os.Remove(path)
+}
@@ -0,0 +1,105 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package server
+
+import(
+    "os"
+    "net"
+    "time"
+    "bufio"
+    "errors"
+    "testing"
+    "io/fs"
+    "path/filepath"
+)
+
+func echoLine(t *testing.T, conn net.Conn) {
+    conn.Write([]byte("ping\n"))
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil || line != "ping\n" {
+        t.Fatal(line, err)
+    }
+}
+
+func TestServeListener(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := NewServer("", &EchoHandler{}, NewLineProtocol(64))
+    done := make(chan error, 1)
+    go func() {
+        done <- s.Serve(l)
+    }()
+
+    conn, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    echoLine(t, conn)
+
+    s.Stop()
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestUnixSocket(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "server.sock")
+    stale, err := net.Listen("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stale.(*net.UnixListener).SetUnlinkOnClose(false)
+    stale.Close()
+
+    s := NewServer(path, &EchoHandler{}, NewLineProtocol(64), WithUnixSocket(0600))
+    startServer(t, s)
+    defer s.Stop()
+
+    fi, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fi.Mode().Perm() != 0600 {
+        t.Fatal("socket permissions: ", fi.Mode().Perm())
+    }
+
+    conn, err := net.Dial("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    echoLine(t, conn)
+
+    other := NewServer(path, &EchoHandler{}, NewLineProtocol(64), WithUnixSocket(0))
+    if err := other.Start(); !errors.Is(err, ErrSocketInUse) {
+        t.Fatal("socket in use: ", err)
+    }
+    other.Stop()
+
+    s.Stop()
+    if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+        t.Fatal("socket was not removed: ", err)
+    }
+}
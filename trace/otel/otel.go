@@ -0,0 +1,94 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+// Package otel adapts OpenTelemetry tracers to the tracing hooks of the
+// server and workerpool packages. It is a module of its own so that only
+// its users depend on OpenTelemetry.
+package otel
+
+import(
+    "fmt"
+    "context"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/attribute"
+    oteltrace "go.opentelemetry.io/otel/trace"
+    "github.com/kdruelle/gutils/trace"
+)
+
+// NewTracer returns a trace.Tracer starting its spans with t, for instance
+// otel.Tracer("github.com/kdruelle/gutils/server").
+func NewTracer(t oteltrace.Tracer) (trace.Tracer) {
+    return tracer{t}
+}
+
+type tracer struct {
+    t oteltrace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string, attrs ...trace.Attribute) (context.Context, trace.Span) {
+    ctx, s := t.t.Start(ctx, name, oteltrace.WithAttributes(convert(attrs)...))
+    return ctx, span{s}
+}
+
+type span struct {
+    s oteltrace.Span
+}
+
+func (s span) SetAttributes(attrs ...trace.Attribute) {
+    s.s.SetAttributes(convert(attrs)...)
+}
+
+func (s span) End(err error) {
+    if err != nil {
+        s.s.RecordError(err)
+        s.s.SetStatus(codes.Error, err.Error())
+    }
+    s.s.End()
+}
+
+func convert(attrs []trace.Attribute) ([]attribute.KeyValue) {
+    kvs := make([]attribute.KeyValue, 0, len(attrs))
+    for _, a := range attrs {
+        kvs = append(kvs, keyValue(a))
+    }
+    return kvs
+}
+
+func keyValue(a trace.Attribute) (attribute.KeyValue) {
+    switch v := a.Value.(type) {
+    case string:
+        return attribute.String(a.Key, v)
+    case bool:
+        return attribute.Bool(a.Key, v)
+    case int:
+        return attribute.Int(a.Key, v)
+    case int64:
+        return attribute.Int64(a.Key, v)
+    case uint64:
+        return attribute.Int64(a.Key, int64(v))
+    case float64:
+        return attribute.Float64(a.Key, v)
+    case []string:
+        return attribute.StringSlice(a.Key, v)
+    case fmt.Stringer:
+        return attribute.String(a.Key, v.String())
+    }
+    return attribute.String(a.Key, fmt.Sprint(a.Value))
+}
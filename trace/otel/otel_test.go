@@ -0,0 +1,61 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+package otel
+
+import(
+    "errors"
+    "context"
+    "testing"
+    "go.opentelemetry.io/otel/codes"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/trace/tracetest"
+    "github.com/kdruelle/gutils/trace"
+)
+
+func TestTracer(t *testing.T) {
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+    tracer := NewTracer(provider.Tracer("test"))
+
+    ctx, parent := tracer.Start(context.Background(), "parent", trace.Attr("id", uint64(7)))
+    _, child := tracer.Start(ctx, "child")
+    child.SetAttributes(trace.Attr("ok", false))
+    child.End(errors.New("failed"))
+    parent.End(nil)
+
+    spans := recorder.Ended()
+    if len(spans) != 2 {
+        t.Fatal(len(spans), " spans")
+    }
+    c, p := spans[0], spans[1]
+    if c.Parent().SpanID() != p.SpanContext().SpanID() {
+        t.Fatal("child span is not a child of its parent")
+    }
+    if c.Status().Code != codes.Error || p.Status().Code != codes.Unset {
+        t.Fatal("statuses: ", c.Status(), ", ", p.Status())
+    }
+    if a := p.Attributes(); len(a) != 1 || a[0].Value.AsInt64() != 7 {
+        t.Fatal("parent attributes: ", a)
+    }
+    if a := c.Attributes(); len(a) != 1 || a[0].Value.AsBool() {
+        t.Fatal("child attributes: ", a)
+    }
+}
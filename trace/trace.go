@@ -0,0 +1,79 @@
+////////////////////////////////////////////////////////////////////////////////
+// 
+// (C) 2011 Kevin Druelle <kevin@druelle.info>
+//
+// this software is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This software is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this software.  If not, see <http://www.gnu.org/licenses/>.
+// 
+///////////////////////////////////////////////////////////////////////////////
+
+
+// Package trace defines the tracing hooks of the server and workerpool
+// packages. A Tracer starts spans around the steps of the life of a
+// connection or of a job; the package itself depends on nothing, adapters
+// to tracing libraries live in their own modules.
+package trace
+
+import(
+    "context"
+)
+
+// Attribute is a key-value pair describing a span. Values are strings,
+// booleans, integers or floats.
+type Attribute struct {
+    Key     string
+    Value   any
+}
+
+// Attr makes an Attribute.
+func Attr(key string, value any) (Attribute) {
+    return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans. The returned context carries the new span, so that
+// the spans started from it are its children.
+type Tracer interface {
+    Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation being traced.
+type Span interface {
+    // SetAttributes adds attributes to the span.
+    SetAttributes(attrs ...Attribute)
+    // End ends the span, marking it failed if err is not nil.
+    End(err error)
+}
+
+// Nop returns a Tracer whose spans do nothing.
+func Nop() (Tracer) {
+    return nopTracer{}
+}
+
+// IsNop reports whether t is nil or the Tracer returned by Nop, letting
+// callers skip building the attributes of spans nobody records.
+func IsNop(t Tracer) (bool) {
+    _, ok := t.(nopTracer)
+    return ok || t == nil
+}
+
+type nopTracer struct {}
+
+func (nopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+    return ctx, nopSpan{}
+}
+
+type nopSpan struct {}
+
+func (nopSpan) SetAttributes(attrs ...Attribute) {}
+
+func (nopSpan) End(err error) {}
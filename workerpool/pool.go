@@ -19,26 +19,44 @@
 
 package workerpool
 
+import(
+    "time"
+    "context"
+    "sync/atomic"
+    "github.com/kdruelle/gutils/trace"
+)
 
 type WorkerPool struct {
     maxWorkers      int
     workers         []*Worker
-    jobQueue        chan Job
+    jobQueue        chan poolJob
     pool            chan chan Job
     stopChan        chan bool
+    queued          atomic.Int64
+    busy            atomic.Int64
+    tracer          trace.Tracer
+    ids             map[chan Job]int
 }
 
 
 func NewWorkerPool(workers, queueLength int) (*WorkerPool) {
     p := &WorkerPool{
         maxWorkers: workers,
-        jobQueue:   make(chan Job, queueLength),
+        jobQueue:   make(chan poolJob, queueLength),
         pool:       make(chan chan Job, workers),
         stopChan:   make(chan bool),
+        tracer:     trace.Nop(),
+        ids:        make(map[chan Job]int),
     }
     return p
 }
 
+// SetTracer makes the pool start a span around each job. It must be called
+// before Run.
+func (p * WorkerPool) SetTracer(t trace.Tracer) {
+    p.tracer = t
+}
+
 func (p * WorkerPool) Stop() {
     if p.Stopped() {
         return
@@ -60,12 +78,29 @@ func (p * WorkerPool) Stopped() (bool) {
 }
 
 func (p * WorkerPool) Handle(job Job) {
-    p.jobQueue <- job
+    p.queued.Add(1)
+    p.jobQueue <- poolJob{pool: p, job: job, queued: time.Now()}
+}
+
+// QueueDepth returns the number of jobs waiting for a worker.
+func (p * WorkerPool) QueueDepth() (int) {
+    return int(p.queued.Load())
+}
+
+// Busy returns the number of workers running a job.
+func (p * WorkerPool) Busy() (int) {
+    return int(p.busy.Load())
+}
+
+// Workers returns the number of workers of the pool.
+func (p * WorkerPool) Workers() (int) {
+    return p.maxWorkers
 }
 
 func (p * WorkerPool) Run() {
     for i := 0; i < p.maxWorkers; i++ {
         w := NewWorker(p.pool)
+        p.ids[w.jobsChan] = i
         w.Start()
         p.workers = append(p.workers, w)
     }
@@ -81,15 +116,64 @@ func (p * WorkerPool) dispatch() {
                     p.stopChan <- true
                     return
                 }
-                if job != nil {
-                    go func (job Job) {
-                        jobChan := <-p.pool
-                        jobChan <- job
-                    }(job)
+                if job.job == nil {
+                    p.queued.Add(-1)
+                    continue
                 }
+                go func (job poolJob) {
+                    jobChan := <-p.pool
+                    p.queued.Add(-1)
+                    job.worker = p.ids[jobChan]
+                    jobChan <- job
+                }(job)
             }
         }
     }()
 }
 
+// ContextJob is a Job carrying a context. The span of the job is a child of
+// the context returned by Context, and DoContext is called instead of Do
+// with a context carrying the span.
+type ContextJob interface {
+    Job
+    Context() context.Context
+    DoContext(ctx context.Context)
+}
+
+// poolJob is a job queued in a pool. It counts the busy workers and traces
+// the job.
+type poolJob struct {
+    pool    *WorkerPool
+    job     Job
+    queued  time.Time
+    worker  int
+}
+
+func (j poolJob) Do() {
+    j.pool.busy.Add(1)
+    defer j.pool.busy.Add(-1)
+
+    cj, ok := j.job.(ContextJob)
+    if trace.IsNop(j.pool.tracer) {
+        if ok {
+            cj.DoContext(cj.Context())
+        } else {
+            j.job.Do()
+        }
+        return
+    }
+    parent := context.Background()
+    if ok {
+        parent = cj.Context()
+    }
+    ctx, span := j.pool.tracer.Start(parent, "workerpool.job",
+        trace.Attr("workerpool.worker", j.worker),
+        trace.Attr("workerpool.wait_seconds", time.Since(j.queued).Seconds()))
+    defer span.End(nil)
+    if ok {
+        cj.DoContext(ctx)
+    } else {
+        j.job.Do()
+    }
+}
 